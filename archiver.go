@@ -1,25 +1,26 @@
 package obelisk
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"net/http"
 	nurl "net/url"
 	"os"
 	"path/filepath"
-	"strings"
-	"sync"
 	"time"
 
-	"github.com/cenkalti/backoff/v4"
 	"github.com/kennygrant/sanitize"
+	"golang.org/x/net/html"
 	"golang.org/x/sync/semaphore"
 )
 
 var (
 	defaultUserAgent = "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:73.0) Gecko/20100101 Firefox/73.0"
-	maxElapsedTime   = 30 * time.Second
+	defaultCacheSize = int64(100 * 1024 * 1024)
 )
 
 // Request is data of archival request.
@@ -27,7 +28,10 @@ type Request struct {
 	Input io.Reader
 	URL   string
 
-	// Deprecated: Use `Archiver.WithCookies` instead.
+	// Options overrides the archiver's configuration for this request only.
+	Options []Option
+
+	// Deprecated: Use `WithCookies` in `Options` instead.
 	Cookies []*http.Cookie
 
 	origin *nurl.URL // The original URL request was based from the input. If there are no redirects, it should be the same as `URL`.
@@ -37,35 +41,108 @@ type Request struct {
 type Asset struct {
 	Data        []byte
 	ContentType string
+	FetchedAt   time.Time
+
+	// HTTP caching information, used to revalidate the asset once it's stale.
+	// Zero Expires means the asset is already stale.
+	ETag         string
+	LastModified string
+	Expires      time.Time
 }
 
 // Archiver is the core of obelisk, which used to download a
-// web page then embeds its assets.
+// web page then embeds its assets. Its fields must not be modified
+// after it's validated, use `Request.Options` to change configuration
+// for a single request.
 type Archiver struct {
-	sync.RWMutex
-
-	Cache map[string]Asset
+	// Cache is storage for the downloaded assets. If it's not specified,
+	// an in-memory LRU cache limited to 100 MB will be used.
+	Cache AssetCache
 
 	UserAgent        string
 	EnableLog        bool
 	EnableVerboseLog bool
 
+	// Header is the headers that sent with every request, while HostHeaders
+	// is the headers that only sent to the host (and its subdomains) in the
+	// map key. Host headers replace the headers with the same name.
+	Header      http.Header
+	HostHeaders map[string]http.Header
+
+	// Credentials is used to answer Basic and Digest authentication from
+	// the host in the map key. Credential for host "*" is used for the host
+	// of archived page, but never for its subresources.
+	Credentials map[string]Credential
+
+	// Logger is the logger for archival process. If it's specified,
+	// `EnableLog` and `EnableVerboseLog` are ignored.
+	Logger Logger
+
 	DisableJS     bool
 	DisableCSS    bool
 	DisableEmbeds bool
 	DisableMedias bool
 
-	Transport             http.RoundTripper
+	// FilterRules decides which resources should be kept as remote URL.
+	FilterRules []FilterRule
+
+	// MaxResourceSize is the maximum size of a single resource, while
+	// MaxArchiveSize is the maximum total size of resources embedded in
+	// an archive. Resources that exceed them are kept as remote URL.
+	// Zero means there is no limit.
+	MaxResourceSize int64
+	MaxArchiveSize  int64
+
+	Transport             http.RoundTripper // if set, Proxies and TLS configuration are ignored
 	RequestTimeout        time.Duration
+	ArchiveTimeout        time.Duration // maximum time for the entire archival
 	MaxRetries            int
+	RetryPolicy           RetryPolicy // if not set, BackoffRetry with MaxRetries is used
 	MaxConcurrentDownload int64
 	SkipResourceURLError  bool
 	WrapDirectory         string // directory to stores resources
 
+	// MaxConcurrentPerHost limits the concurrent downloads from a single
+	// host, while HostRateLimit limits the requests per second sent to a
+	// single host. Both are shared by every archival that uses the same
+	// archiver. Zero means there is no limit.
+	MaxConcurrentPerHost int64
+	HostRateLimit        float64
+
+	// Observer receives events of the archival process.
+	Observer Observer
+
+	// CookieJar stores cookies that sent with requests, including the ones
+	// set by server while archiving. If it's not set, each archival uses
+	// its own empty jar.
+	CookieJar http.CookieJar
+
+	// Proxies decides the proxy for each request. Requests that don't match
+	// any rule use proxy from environment variables.
+	Proxies []ProxyRule
+
+	// InsecureSkipVerify disables verification of server's TLS certificate,
+	// while RootCAs is the certificate authorities that used to verify it.
+	// If RootCAs is nil, the system's certificate authorities are used.
+	InsecureSkipVerify bool
+	RootCAs            *x509.CertPool
+
+	// ClientCertificates are presented to server that asks for client
+	// certificate, e.g. for mutual TLS.
+	ClientCertificates []tls.Certificate
+
+	// ResolveOverrides connects to the address in map value instead of
+	// resolving the "host:port" in map key, like curl's `--resolve`.
+	ResolveOverrides map[string]string
+
 	isValidated bool
+	logger      Logger
 	cookies     []*http.Cookie
 	httpClient  *http.Client
 	dlSemaphore *semaphore.Weighted
+	hostLimiter *hostLimiter
+	retryPolicy RetryPolicy
+	transport   http.RoundTripper
 }
 
 // Validate prepares Archiver to make sure its configurations
@@ -73,94 +150,247 @@ type Archiver struct {
 // archival started.
 func (arc *Archiver) Validate() {
 	if arc.Cache == nil {
-		arc.Cache = make(map[string]Asset)
+		arc.Cache = NewMemoryCache(defaultCacheSize)
 	}
 
 	if arc.UserAgent == "" {
 		arc.UserAgent = defaultUserAgent
 	}
 
+	if arc.Observer == nil {
+		arc.Observer = NopObserver{}
+	}
+
 	if arc.MaxConcurrentDownload <= 0 {
 		arc.MaxConcurrentDownload = 10
 	}
 
 	arc.isValidated = true
+	arc.logger = arc.resolveLogger()
+	arc.retryPolicy = arc.resolveRetryPolicy()
 	arc.dlSemaphore = semaphore.NewWeighted(arc.MaxConcurrentDownload)
+	arc.hostLimiter = newHostLimiter(arc.MaxConcurrentPerHost, arc.HostRateLimit)
+
+	arc.transport = arc.resolveTransport()
+	arc.httpClient = arc.newHTTPClient()
+}
 
-	if arc.Transport == nil {
-		arc.Transport = http.DefaultTransport
+func (arc *Archiver) resolveRetryPolicy() RetryPolicy {
+	if arc.RetryPolicy != nil {
+		return arc.RetryPolicy
 	}
+	return NewBackoffRetry(arc.MaxRetries)
+}
 
-	arc.httpClient = &http.Client{
+func (arc *Archiver) newHTTPClient() *http.Client {
+	transport := arc.transport
+	if len(arc.Credentials) > 0 {
+		transport = newAuthTransport(transport, arc.Credentials)
+	}
+
+	if len(arc.HostHeaders) > 0 {
+		transport = &hostHeaderTransport{base: transport, hostHeaders: arc.HostHeaders}
+	}
+
+	return &http.Client{
 		Timeout:   arc.RequestTimeout,
-		Transport: arc.Transport,
+		Transport: transport,
+		Jar:       arc.CookieJar,
 	}
 }
 
 // Archive starts archival process for the specified request.
 // Returns the archival result, content type and error if there are any.
 func (arc *Archiver) Archive(ctx context.Context, req Request) ([]byte, string, error) {
+	buffer := bytes.NewBuffer(nil)
+	result, err := arc.ArchiveTo(ctx, req, buffer)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return buffer.Bytes(), result.ContentType, nil
+}
+
+// ArchiveTo starts archival process for the specified request, then
+// streams the archive into w. Returns the archival result which lists
+// the resources of the web page, and error if there are any. Once the
+// archival is started, the result is returned even when it's failed, so
+// the resources that processed before the failure can be inspected.
+func (arc *Archiver) ArchiveTo(ctx context.Context, req Request, w io.Writer) (result *ArchiveResult, err error) {
 	// Make sure archiver has been validated
 	if !arc.isValidated {
-		return nil, "", fmt.Errorf("archiver hasn't been validated")
+		return nil, fmt.Errorf("archiver hasn't been validated")
+	}
+
+	// Apply configuration for this request
+	opts := req.Options
+	if len(req.Cookies) > 0 {
+		opts = append([]Option{WithCookies(req.Cookies)}, opts...)
+	}
+	if arc.CookieJar == nil {
+		opts = append([]Option{WithCookieJar(NewCookieJar())}, opts...)
+	}
+	shared := arc
+	arc = arc.withOptions(opts...)
+
+	// If the options need their own transport, it's only used for this
+	// request, so close its connections once the request is done
+	if transport, ok := arc.transport.(*http.Transport); ok && arc.Transport == nil &&
+		transport != shared.transport && transport != http.DefaultTransport {
+		defer transport.CloseIdleConnections()
 	}
 
 	// Validate request
 	if req.URL == "" {
-		return nil, "", fmt.Errorf("request url is not specified")
+		return nil, fmt.Errorf("request url is not specified")
 	}
 
 	url, err := nurl.Parse(req.URL)
 	if err != nil || url.Scheme == "" || url.Hostname() == "" {
-		return nil, "", fmt.Errorf("url \"%s\" is not valid", req.URL)
+		return nil, fmt.Errorf("url \"%s\" is not valid", req.URL)
+	}
+	// Notify observer about the archival progress
+	start := time.Now()
+	arc.Observer.PageStarted(Event{URL: req.URL})
+	arc.logger.Debug("archival started", "url", req.URL)
+
+	defer func() {
+		e := Event{URL: req.URL, Duration: time.Since(start), Err: err}
+		if result != nil {
+			e.Bytes = result.Size
+		}
+		arc.Observer.PageFinished(e)
+
+		if err != nil {
+			arc.logger.Warn("archival failed", "url", req.URL, "error", err)
+		} else {
+			arc.logger.Debug("archival finished", "url", req.URL,
+				"size", result.Size, "resources", len(result.Resources), "duration", e.Duration)
+		}
+	}()
+
+	// Limit the time for the entire archival
+	if arc.ArchiveTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, arc.ArchiveTimeout)
+		defer cancel()
 	}
+
 	// Set the original url
 	req.origin = url
 	ctx = withOrigin(ctx, req.origin)
-	url = arc.finalURI(url)
+	url = arc.finalURI(ctx, url)
+
+	result = &ArchiveResult{
+		URL:         req.origin.String(),
+		FinalURL:    url.String(),
+		ContentType: "text/html",
+	}
 
 	// If needed download page from source URL
-	contentType := "text/html"
 	if req.Input == nil {
-		resp, err := arc.downloadFile(url.String(), "")
+		resp, err := arc.downloadFile(ctx, url.String(), "", nil)
+		if resp != nil {
+			result.FinalURL = resp.Request.URL.String()
+			result.StatusCode = resp.StatusCode
+			result.ContentType = resp.Header.Get("Content-Type")
+		}
 		if err != nil {
-			return nil, "", fmt.Errorf("download failed: %w", err)
+			return result, fmt.Errorf("download failed: %w", err)
 		}
 		defer resp.Body.Close()
 
 		req.Input = resp.Body
-		contentType = resp.Header.Get("Content-Type")
 	}
 
 	// Check the type of the downloaded file.
-	// If it's not HTML, just return it as it is.
-	if !strings.HasPrefix(contentType, "text/html") {
-		content, err := io.ReadAll(req.Input)
-		return content, contentType, err
+	// If it's not HTML, just copy it as it is.
+	cw := &countingWriter{w: w}
+	if mediaType := mediaTypeOf(result.ContentType); mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		_, err := io.Copy(cw, req.Input)
+		result.Size = cw.n
+		return result, err
 	}
 
 	// If it's HTML process it
-	result, err := arc.processHTML(ctx, req.Input, url, false)
+	recorder := newResourceRecorder()
+	defer func() { result.Resources = recorder.list() }()
+
+	assets := newDeferredAssets()
+	ctx = withResourceRecorder(ctx, recorder)
+	ctx = withDeferredAssets(ctx, assets)
+	ctx = withFetchFlights(ctx, newFetchFlights())
+	if arc.MaxArchiveSize > 0 {
+		ctx = withSizeBudget(ctx, newSizeBudget(arc.MaxArchiveSize))
+	}
+	input, err := newHTMLDecoder(req.Input, result.ContentType)
 	if err != nil {
-		return nil, "", err
+		return result, err
+	}
+
+	// The document is decoded into UTF-8, which is also used for output
+	result.ContentType = withUTF8Charset(result.ContentType)
+
+	doc, err := arc.processHTMLDocument(ctx, input, url, url.String(), false)
+	if err != nil {
+		return result, err
+	}
+
+	// Some resources might be left out if the archival is cancelled
+	// while processing, so make sure it's not the case
+	if err := ctx.Err(); err != nil {
+		return result, err
 	}
 
-	return s2b(result), contentType, nil
+	// Serialize the document, encoding the large assets along the way
+	dw := assets.writer(cw)
+	if err := html.Render(dw, doc); err != nil {
+		result.Size = cw.n
+		return result, err
+	}
+
+	if err := dw.Flush(); err != nil {
+		result.Size = cw.n
+		return result, err
+	}
+
+	result.Size = cw.n
+	return result, nil
 }
 
-// WithCookies attach request cookies to `Archiver`.
+// WithCookies returns a copy of `Archiver` which attach the specified
+// cookies to its requests. The original archiver is not modified.
+//
+// Deprecated: Use `WithCookies` in `Request.Options` instead.
 func (arc *Archiver) WithCookies(cookies []*http.Cookie) *Archiver {
-	arc.cookies = cookies
-	return arc
+	return arc.withOptions(WithCookies(cookies))
+}
+
+// setHeaders adds the global headers and user agent into the request. Host
+// headers are added by the transport, so they are applied on each redirect.
+func (arc *Archiver) setHeaders(req *http.Request) {
+	for key, values := range arc.Header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", arc.UserAgent)
+	}
 }
 
 // finalURI returns the final URL that has been redirected to another URL.
-func (arc *Archiver) finalURI(u *nurl.URL) *nurl.URL {
-	req, err := http.NewRequest(http.MethodHead, u.String(), nil)
+func (arc *Archiver) finalURI(ctx context.Context, u *nurl.URL) *nurl.URL {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
 	if err != nil {
 		return u
 	}
-	req.Header.Set("User-Agent", arc.UserAgent)
+	arc.setHeaders(req)
+
+	if err := arc.hostLimiter.wait(ctx, u.Host); err != nil {
+		return u
+	}
 
 	resp, err := arc.httpClient.Do(req)
 	if err != nil {
@@ -171,13 +401,19 @@ func (arc *Archiver) finalURI(u *nurl.URL) *nurl.URL {
 	return resp.Request.URL
 }
 
-func (arc *Archiver) downloadFile(url string, parentURL string) (*http.Response, error) {
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+func (arc *Archiver) downloadFile(ctx context.Context, url string, parentURL string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Set("User-Agent", arc.UserAgent)
+	arc.setHeaders(req)
+	for key, values := range header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
 	if parentURL != "" {
 		req.Header.Set("Referer", parentURL)
 	}
@@ -186,29 +422,59 @@ func (arc *Archiver) downloadFile(url string, parentURL string) (*http.Response,
 		req.AddCookie(cookie)
 	}
 
-	var resp *http.Response
-	op := func() error {
-		var err error
-		resp, err = arc.httpClient.Do(req) //nolint:bodyclose,goimports
-		if err == nil && (resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests) {
+	// Send the request, retry it as long as the retry policy allows
+	for attempt := 1; ; attempt++ {
+		if err := arc.hostLimiter.wait(ctx, req.URL.Host); err != nil {
+			return nil, err
+		}
+
+		resp, err := arc.httpClient.Do(req) //nolint:bodyclose
+		if err == nil && isFailureStatus(arc.retryPolicy, resp.StatusCode) {
 			err = fmt.Errorf("failed to fetch with status code: %d", resp.StatusCode)
 		}
-		return err
-	}
-	exp := backoff.NewExponentialBackOff()
-	exp.MaxElapsedTime = maxElapsedTime
-	bo := backoff.WithMaxRetries(exp, uint64(arc.MaxRetries))
-	err = backoff.Retry(op, bo)
 
-	return resp, err
+		if ctx.Err() != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		}
+
+		delay, retry := arc.retryPolicy.Retry(attempt, resp, err)
+		if !retry {
+			// Only the status of failed response is used, so close its body
+			if err != nil && resp != nil {
+				resp.Body.Close()
+			}
+			return resp, err
+		}
+
+		if resp != nil {
+			discardBody(resp)
+		}
+
+		arc.logger.Debug("retrying request", "url", url, "attempt", attempt, "delay", delay, "error", err)
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
 }
 
-func (arc *Archiver) transform(uri string, content []byte, contentType string) string {
+func (arc *Archiver) transform(ctx context.Context, uri string, content []byte, contentType string) string {
 	// If no directory to store files is specified, save as a single file.
 	if arc.WrapDirectory == "" {
 		if contentType == "" {
 			contentType = http.DetectContentType(content)
 		}
+
+		// If archive is streamed, large asset will be encoded later
+		// straight into the output.
+		if assets := deferredAssetsFromContext(ctx); assets != nil && len(content) >= streamThreshold {
+			if placeholder, ok := assets.add(content, contentType); ok {
+				return placeholder
+			}
+		}
+
 		return createDataURL(content, contentType)
 	}
 
@@ -0,0 +1,289 @@
+package obelisk
+
+import (
+	"context"
+	"crypto/md5" //nolint:gosec
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Credential is the username and password for HTTP authentication.
+type Credential struct {
+	Username string
+	Password string
+}
+
+// credentialFor returns the credential for the host, which must match the
+// host exactly. Credential for host "*" is only used for the page that being
+// archived, so it's never sent to hosts of its subresources.
+func credentialFor(ctx context.Context, credentials map[string]Credential, host string) (Credential, bool) {
+	for pattern, cred := range credentials {
+		if pattern != "*" && strings.EqualFold(pattern, host) {
+			return cred, true
+		}
+	}
+
+	if origin := originFromContext(ctx); origin == nil || !strings.EqualFold(origin.Hostname(), host) {
+		return Credential{}, false
+	}
+
+	cred, ok := credentials["*"]
+	return cred, ok
+}
+
+// authTransport is http.RoundTripper that answers Basic and Digest
+// authentication challenge using the credential of the request's host.
+type authTransport struct {
+	base        http.RoundTripper
+	credentials map[string]Credential
+
+	// Challenges from the previous responses, so the next requests to the
+	// same host can be authenticated right away.
+	mutex      sync.Mutex
+	challenges map[string]*authChallenge
+}
+
+func newAuthTransport(base http.RoundTripper, credentials map[string]Credential) *authTransport {
+	return &authTransport{
+		base:        base,
+		credentials: credentials,
+		challenges:  make(map[string]*authChallenge),
+	}
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cred, ok := credentialFor(req.Context(), t.credentials, req.URL.Hostname())
+	if !ok || req.Header.Get("Authorization") != "" {
+		return t.base.RoundTrip(req)
+	}
+
+	// If host asked for authentication before, reuse its challenge
+	host := strings.ToLower(req.URL.Host)
+	t.mutex.Lock()
+	challenge := t.challenges[host]
+	t.mutex.Unlock()
+
+	var resp *http.Response
+	var err error
+	if challenge != nil {
+		resp, err = t.base.RoundTrip(authorizeRequest(req, challenge, cred))
+	} else {
+		resp, err = t.base.RoundTrip(req)
+	}
+
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !canResend(req) {
+		return resp, err
+	}
+
+	// Answer the new challenge. If the credential has been rejected, only
+	// retry if it's because the Digest nonce is expired.
+	newChallenge := parseAuthChallenge(resp.Header.Values("WWW-Authenticate"))
+	if newChallenge == nil {
+		return resp, nil
+	}
+
+	if challenge != nil && !strings.EqualFold(newChallenge.params["stale"], "true") {
+		return resp, nil
+	}
+
+	discardBody(resp)
+	t.mutex.Lock()
+	t.challenges[host] = newChallenge
+	t.mutex.Unlock()
+
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+
+	return t.base.RoundTrip(authorizeRequest(req, newChallenge, cred))
+}
+
+// canResend checks whether the request can be sent again.
+func canResend(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// authChallenge is the authentication challenge from WWW-Authenticate header.
+type authChallenge struct {
+	scheme string // "basic" or "digest"
+	params map[string]string
+
+	mutex sync.Mutex
+	count int // nonce count for Digest
+}
+
+// parseAuthChallenge parses WWW-Authenticate headers and returns the most
+// secure challenge that supported. Returns nil if there are none.
+func parseAuthChallenge(values []string) *authChallenge {
+	var basic, digest *authChallenge
+	for _, value := range values {
+		for _, challenge := range parseAuthHeader(value) {
+			switch {
+			case challenge.scheme == "basic" && basic == nil:
+				basic = challenge
+			case challenge.scheme == "digest" && digest == nil && digestHash(challenge.params["algorithm"]) != nil:
+				digest = challenge
+			}
+		}
+	}
+
+	if digest != nil {
+		return digest
+	}
+	return basic
+}
+
+// parseAuthHeader parses a WWW-Authenticate header that might contain several
+// challenges, e.g. `Digest realm="a", nonce="b", Basic realm="a"`.
+func parseAuthHeader(value string) []*authChallenge {
+	var challenges []*authChallenge
+	var current *authChallenge
+
+	for value = strings.TrimSpace(value); value != ""; value = strings.TrimLeft(value, " \t,") {
+		// Read the token, which is either scheme or parameter name
+		end := strings.IndexAny(value, " \t,=")
+		if end < 0 {
+			end = len(value)
+		}
+		token := value[:end]
+		value = strings.TrimLeft(value[end:], " \t")
+
+		if !strings.HasPrefix(value, "=") {
+			current = &authChallenge{scheme: strings.ToLower(token), params: map[string]string{}}
+			challenges = append(challenges, current)
+			continue
+		}
+
+		// Read the parameter value, which might be quoted
+		value = strings.TrimLeft(value[1:], " \t")
+		var paramValue string
+		if strings.HasPrefix(value, `"`) {
+			var sb strings.Builder
+			i := 1
+			for ; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				sb.WriteByte(value[i])
+			}
+			paramValue = sb.String()
+			value = value[min(i+1, len(value)):]
+		} else {
+			end := strings.IndexAny(value, " \t,")
+			if end < 0 {
+				end = len(value)
+			}
+			paramValue = value[:end]
+			value = value[end:]
+		}
+
+		if current != nil {
+			current.params[strings.ToLower(token)] = paramValue
+		}
+	}
+
+	return challenges
+}
+
+// authorizeRequest returns copy of the request with Authorization header
+// that answers the challenge.
+func authorizeRequest(req *http.Request, challenge *authChallenge, cred Credential) *http.Request {
+	req = req.Clone(req.Context())
+	if challenge.scheme == "digest" {
+		req.Header.Set("Authorization", challenge.digestAuthorization(req, cred))
+	} else {
+		req.SetBasicAuth(cred.Username, cred.Password)
+	}
+	return req
+}
+
+// digestAuthorization creates Digest authorization following RFC 7616.
+func (c *authChallenge) digestAuthorization(req *http.Request, cred Credential) string {
+	algorithm := c.params["algorithm"]
+	newHash := digestHash(algorithm)
+	h := func(s string) string {
+		hasher := newHash()
+		hasher.Write([]byte(s))
+		return hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	c.mutex.Lock()
+	c.count++
+	nc := fmt.Sprintf("%08x", c.count)
+	c.mutex.Unlock()
+
+	cnonceBytes := make([]byte, 16)
+	_, _ = rand.Read(cnonceBytes)
+	cnonce := hex.EncodeToString(cnonceBytes)
+
+	realm, nonce := c.params["realm"], c.params["nonce"]
+	uri := req.URL.RequestURI()
+
+	ha1 := h(cred.Username + ":" + realm + ":" + cred.Password)
+	if strings.HasSuffix(strings.ToLower(algorithm), "-sess") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(req.Method + ":" + uri)
+
+	// Only "auth" quality of protection is supported, since "auth-int"
+	// needs hash of the request body.
+	qop := ""
+	for _, q := range strings.Split(c.params["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+
+	var response string
+	if qop != "" {
+		response = h(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+	} else {
+		response = h(ha1 + ":" + nonce + ":" + ha2)
+	}
+
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace
+	parts := []string{
+		fmt.Sprintf(`username="%s"`, quote(cred.Username)),
+		fmt.Sprintf(`realm="%s"`, quote(realm)),
+		fmt.Sprintf(`nonce="%s"`, quote(nonce)),
+		fmt.Sprintf(`uri="%s"`, quote(uri)),
+		fmt.Sprintf(`response="%s"`, response),
+	}
+
+	if algorithm != "" {
+		parts = append(parts, "algorithm="+algorithm)
+	}
+
+	if opaque, exist := c.params["opaque"]; exist {
+		parts = append(parts, fmt.Sprintf(`opaque="%s"`, quote(opaque)))
+	}
+
+	if qop != "" {
+		parts = append(parts, "qop="+qop, "nc="+nc, fmt.Sprintf(`cnonce="%s"`, cnonce))
+	}
+
+	return "Digest " + strings.Join(parts, ", ")
+}
+
+// digestHash returns the hash function for Digest algorithm, or nil if the
+// algorithm is not supported.
+func digestHash(algorithm string) func() hash.Hash {
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToLower(algorithm), "-sess")) {
+	case "", "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package obelisk
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseAuthHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		expected []*authChallenge
+	}{{
+		name:   "basic",
+		header: `Basic realm="example"`,
+		expected: []*authChallenge{
+			{scheme: "basic", params: map[string]string{"realm": "example"}},
+		},
+	}, {
+		name:   "digest",
+		header: `Digest realm="example", qop="auth,auth-int", nonce="abc", opaque="xyz", algorithm=MD5`,
+		expected: []*authChallenge{
+			{scheme: "digest", params: map[string]string{
+				"realm":     "example",
+				"qop":       "auth,auth-int",
+				"nonce":     "abc",
+				"opaque":    "xyz",
+				"algorithm": "MD5",
+			}},
+		},
+	}, {
+		name:   "several challenges",
+		header: `Digest realm="a", nonce="b", Basic realm="c"`,
+		expected: []*authChallenge{
+			{scheme: "digest", params: map[string]string{"realm": "a", "nonce": "b"}},
+			{scheme: "basic", params: map[string]string{"realm": "c"}},
+		},
+	}, {
+		name:   "escaped quote",
+		header: `Basic realm="say \"hi\", bye"`,
+		expected: []*authChallenge{
+			{scheme: "basic", params: map[string]string{"realm": `say "hi", bye`}},
+		},
+	}, {
+		name:   "case and spaces",
+		header: `  DIGEST  Realm = "a" ,NONCE=b  `,
+		expected: []*authChallenge{
+			{scheme: "digest", params: map[string]string{"realm": "a", "nonce": "b"}},
+		},
+	}, {
+		name:   "without params",
+		header: `Negotiate`,
+		expected: []*authChallenge{
+			{scheme: "negotiate", params: map[string]string{}},
+		},
+	}, {
+		name:     "empty",
+		header:   ``,
+		expected: nil,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			challenges := parseAuthHeader(test.header)
+			if len(challenges) != len(test.expected) {
+				t.Fatalf("got %d challenges, want %d", len(challenges), len(test.expected))
+			}
+
+			for i, challenge := range challenges {
+				expected := test.expected[i]
+				if challenge.scheme != expected.scheme {
+					t.Errorf("challenge %d: got scheme %q, want %q", i, challenge.scheme, expected.scheme)
+				}
+				if !reflect.DeepEqual(challenge.params, expected.params) {
+					t.Errorf("challenge %d: got params %v, want %v", i, challenge.params, expected.params)
+				}
+			}
+		})
+	}
+}
+
+func TestParseAuthChallenge(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  []string
+		expected string // scheme of the chosen challenge
+	}{{
+		name:     "digest preferred",
+		headers:  []string{`Basic realm="a"`, `Digest realm="a", nonce="b"`},
+		expected: "digest",
+	}, {
+		name:     "unsupported digest algorithm",
+		headers:  []string{`Digest realm="a", nonce="b", algorithm=SHA-512-256, Basic realm="a"`},
+		expected: "basic",
+	}, {
+		name:     "unsupported scheme",
+		headers:  []string{`Negotiate`, `Bearer realm="a"`},
+		expected: "",
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var scheme string
+			if challenge := parseAuthChallenge(test.headers); challenge != nil {
+				scheme = challenge.scheme
+			}
+
+			if scheme != test.expected {
+				t.Errorf("got scheme %q, want %q", scheme, test.expected)
+			}
+		})
+	}
+}
+
+func TestDigestAuthorization(t *testing.T) {
+	cred := Credential{Username: "Mufasa", Password: "Circle of Life"}
+
+	tests := []struct {
+		name    string
+		header  string
+		newHash func() hash.Hash
+		hasQop  bool
+	}{{
+		name:    "md5 with qop",
+		header:  `Digest realm="http-auth@example.org", qop="auth, auth-int", nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`,
+		newHash: md5.New,
+		hasQop:  true,
+	}, {
+		name:    "sha-256 with qop",
+		header:  `Digest realm="http-auth@example.org", qop="auth", algorithm=SHA-256, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v"`,
+		newHash: sha256.New,
+		hasQop:  true,
+	}, {
+		name:    "md5 without qop",
+		header:  `Digest realm="testrealm@host.com", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093"`,
+		newHash: md5.New,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			challenge := parseAuthChallenge([]string{test.header})
+			if challenge == nil || challenge.scheme != "digest" {
+				t.Fatalf("digest challenge not parsed")
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, "http://example.org/dir/index.html?a=b", nil)
+			authorization := challenge.digestAuthorization(req, cred)
+			if !strings.HasPrefix(authorization, "Digest ") {
+				t.Fatalf("unexpected authorization %q", authorization)
+			}
+
+			params := parseAuthHeader(authorization)[0].params
+			h := func(s string) string {
+				hasher := test.newHash()
+				hasher.Write([]byte(s))
+				return hex.EncodeToString(hasher.Sum(nil))
+			}
+
+			realm, nonce := challenge.params["realm"], challenge.params["nonce"]
+			ha1 := h(cred.Username + ":" + realm + ":" + cred.Password)
+			ha2 := h("GET:/dir/index.html?a=b")
+
+			var expected string
+			if test.hasQop {
+				if params["qop"] != "auth" || params["nc"] != "00000001" || params["cnonce"] == "" {
+					t.Fatalf("unexpected qop params in %q", authorization)
+				}
+				expected = h(ha1 + ":" + nonce + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+			} else {
+				if _, exist := params["qop"]; exist {
+					t.Fatalf("unexpected qop in %q", authorization)
+				}
+				expected = h(ha1 + ":" + nonce + ":" + ha2)
+			}
+
+			if params["username"] != cred.Username || params["uri"] != "/dir/index.html?a=b" {
+				t.Errorf("unexpected params in %q", authorization)
+			}
+
+			if params["opaque"] != challenge.params["opaque"] {
+				t.Errorf("got opaque %q, want %q", params["opaque"], challenge.params["opaque"])
+			}
+
+			if params["response"] != expected {
+				t.Errorf("got response %q, want %q", params["response"], expected)
+			}
+
+			// Nonce count is increased for each request
+			params = parseAuthHeader(challenge.digestAuthorization(req, cred))[0].params
+			if test.hasQop && params["nc"] != "00000002" {
+				t.Errorf("got nonce count %q, want %q", params["nc"], "00000002")
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package obelisk
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+var (
+	// ErrResourceTooLarge is the error when a resource is larger than `Archiver.MaxResourceSize`.
+	ErrResourceTooLarge = errors.New("resource is larger than the maximum resource size")
+	// ErrArchiveTooLarge is the error when embedding a resource will exceed `Archiver.MaxArchiveSize`.
+	ErrArchiveTooLarge = errors.New("resource doesn't fit in the archive size budget")
+)
+
+type ctxKeySizeBudget struct{}
+
+func withSizeBudget(ctx context.Context, budget *sizeBudget) context.Context {
+	return context.WithValue(ctx, ctxKeySizeBudget{}, budget)
+}
+
+func sizeBudgetFromContext(ctx context.Context) *sizeBudget {
+	if budget, ok := ctx.Value(ctxKeySizeBudget{}).(*sizeBudget); ok {
+		return budget
+	}
+	return nil
+}
+
+// sizeBudget is the remaining size of resources that can be embedded
+// into an archive.
+type sizeBudget struct {
+	remaining atomic.Int64
+}
+
+func newSizeBudget(size int64) *sizeBudget {
+	budget := &sizeBudget{}
+	budget.remaining.Store(size)
+	return budget
+}
+
+// reserve takes n bytes from the budget. Returns false if the remaining
+// budget is not enough.
+func (b *sizeBudget) reserve(n int64) bool {
+	for {
+		remaining := b.remaining.Load()
+		if remaining < n {
+			return false
+		}
+
+		if b.remaining.CompareAndSwap(remaining, remaining-n) {
+			return true
+		}
+	}
+}
+
+// available returns the remaining budget, or -1 if there are no budget.
+func (b *sizeBudget) available() int64 {
+	if b == nil {
+		return -1
+	}
+	return b.remaining.Load()
+}
+
+// sizeLimitReader is io.Reader that counts the bytes read through it, and
+// returns ErrResourceTooLarge once it's more than the limit.
+type sizeLimitReader struct {
+	r        io.Reader
+	limit    int64 // negative means unlimited
+	n        int64
+	exceeded bool
+}
+
+func (lr *sizeLimitReader) Read(p []byte) (int, error) {
+	if lr.exceeded {
+		return 0, ErrResourceTooLarge
+	}
+
+	n, err := lr.r.Read(p)
+	lr.n += int64(n)
+	if lr.limit >= 0 && lr.n > lr.limit {
+		lr.exceeded = true
+		return n, ErrResourceTooLarge
+	}
+
+	return n, err
+}
@@ -0,0 +1,196 @@
+package obelisk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	nurl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DiskCache is an AssetCache which persists assets in a directory, so it
+// can be reused across runs and shared by several processes at once.
+// Asset bodies are stored by their SHA-256 digest so identical content
+// is only saved once, while the metadata is keyed by the normalized URL.
+type DiskCache struct {
+	dir string
+}
+
+type diskCacheEntry struct {
+	URL          string    `json:"url"`
+	Digest       string    `json:"digest"`
+	Size         int64     `json:"size"`
+	ContentType  string    `json:"contentType"`
+	FetchedAt    time.Time `json:"fetchedAt"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Expires      time.Time `json:"expires"`
+}
+
+// NewDiskCache returns a DiskCache that stores its data inside dir,
+// creating the directory if necessary.
+func NewDiskCache(dir string) (*DiskCache, error) {
+	for _, subDir := range []string{"objects", "entries"} {
+		if err := os.MkdirAll(filepath.Join(dir, subDir), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create cache dir: %w", err)
+		}
+	}
+
+	return &DiskCache{dir: dir}, nil
+}
+
+// Get returns the asset which cached for the specified URL.
+func (c *DiskCache) Get(url string) (Asset, bool) {
+	content, err := os.ReadFile(c.entryPath(url))
+	if err != nil {
+		return Asset{}, false
+	}
+
+	// The cache might be shared with other processes, so damaged or foreign
+	// entry is treated as missing instead of trusted
+	var entry diskCacheEntry
+	if err := json.Unmarshal(content, &entry); err != nil || !isValidDigest(entry.Digest) {
+		return Asset{}, false
+	}
+
+	data, err := os.ReadFile(c.objectPath(entry.Digest))
+	if err != nil || int64(len(data)) != entry.Size {
+		return Asset{}, false
+	}
+
+	if digest := sha256.Sum256(data); hex.EncodeToString(digest[:]) != entry.Digest {
+		return Asset{}, false
+	}
+
+	return Asset{
+		Data:         data,
+		ContentType:  entry.ContentType,
+		FetchedAt:    entry.FetchedAt,
+		ETag:         entry.ETag,
+		LastModified: entry.LastModified,
+		Expires:      entry.Expires,
+	}, true
+}
+
+// Put saves the asset for the specified URL. Errors are ignored since
+// failing to cache an asset should not fail the archival.
+func (c *DiskCache) Put(url string, asset Asset) {
+	digest := sha256.Sum256(asset.Data)
+	hexDigest := hex.EncodeToString(digest[:])
+
+	// Objects are content-addressed, so if it already exists
+	// there is no need to write it again.
+	objectPath := c.objectPath(hexDigest)
+	if _, err := os.Stat(objectPath); err != nil {
+		if err := writeFileAtomic(objectPath, asset.Data); err != nil {
+			return
+		}
+	}
+
+	fetchedAt := asset.FetchedAt
+	if fetchedAt.IsZero() {
+		fetchedAt = time.Now()
+	}
+
+	entry, err := json.Marshal(diskCacheEntry{
+		URL:          normalizeURL(url),
+		Digest:       hexDigest,
+		Size:         int64(len(asset.Data)),
+		ContentType:  asset.ContentType,
+		FetchedAt:    fetchedAt.UTC(),
+		ETag:         asset.ETag,
+		LastModified: asset.LastModified,
+		Expires:      asset.Expires.UTC(),
+	})
+	if err != nil {
+		return
+	}
+
+	_ = writeFileAtomic(c.entryPath(url), entry)
+}
+
+// Delete removes the entry for the specified URL. The stored body is
+// kept since it might be shared with other URLs.
+func (c *DiskCache) Delete(url string) {
+	_ = os.Remove(c.entryPath(url))
+}
+
+func (c *DiskCache) entryPath(url string) string {
+	digest := sha256.Sum256([]byte(normalizeURL(url)))
+	name := hex.EncodeToString(digest[:])
+	return filepath.Join(c.dir, "entries", name[:2], name+".json")
+}
+
+func (c *DiskCache) objectPath(hexDigest string) string {
+	return filepath.Join(c.dir, "objects", hexDigest[:2], hexDigest)
+}
+
+// isValidDigest checks whether the digest is a hex encoded SHA-256, as written
+// by Put.
+func isValidDigest(hexDigest string) bool {
+	if len(hexDigest) != 2*sha256.Size {
+		return false
+	}
+
+	for _, r := range hexDigest {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFileAtomic writes data into a temporary file then renames it to
+// path, so concurrent readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// normalizeURL returns URL in its canonical form : lowercase scheme and
+// host, without default port and fragment.
+func normalizeURL(url string) string {
+	u, err := nurl.Parse(strings.TrimSpace(url))
+	if err != nil {
+		return url
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	u.RawFragment = ""
+
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		u.Host = strings.TrimSuffix(u.Host, ":"+port)
+	}
+
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	return u.String()
+}
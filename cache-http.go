@@ -0,0 +1,121 @@
+package obelisk
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxHeuristicLifetime is the longest time an asset considered fresh
+// when its lifetime is guessed from Last-Modified header.
+var maxHeuristicLifetime = 24 * time.Hour
+
+// defaultLifetime is how long an asset considered fresh when the response
+// doesn't tell its lifetime at all.
+var defaultLifetime = 10 * time.Minute
+
+// isFresh checks if the cached asset can be used without asking the server.
+// Asset without any expiry information is considered stale.
+func (a Asset) isFresh(now time.Time) bool {
+	return now.Before(a.Expires)
+}
+
+// canRevalidate checks if the asset has validator that can be used
+// to send conditional request.
+func (a Asset) canRevalidate() bool {
+	return a.ETag != "" || a.LastModified != ""
+}
+
+// conditionalHeader returns headers to revalidate the asset to server.
+func (a Asset) conditionalHeader() http.Header {
+	header := http.Header{}
+	if a.ETag != "" {
+		header.Set("If-None-Match", a.ETag)
+	}
+	if a.LastModified != "" {
+		header.Set("If-Modified-Since", a.LastModified)
+	}
+	return header
+}
+
+// updateFromHeader saves the caching information from response header into
+// the asset. Returns false if the response is not allowed to be cached.
+func (a *Asset) updateFromHeader(header http.Header, now time.Time) bool {
+	if etag := header.Get("ETag"); etag != "" {
+		a.ETag = etag
+	}
+
+	if lastModified := header.Get("Last-Modified"); lastModified != "" {
+		a.LastModified = lastModified
+	}
+
+	a.FetchedAt = now
+	a.Expires = time.Time{}
+
+	// Parse Cache-Control directives
+	maxAge := -1
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store":
+			return false
+		case "no-cache":
+			maxAge = 0
+		case "max-age":
+			if maxAge != 0 {
+				if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && seconds >= 0 {
+					maxAge = seconds
+				}
+			}
+		}
+	}
+
+	// Cache-Control has priority over the other headers
+	if maxAge >= 0 {
+		lifetime := time.Duration(maxAge) * time.Second
+		if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+			lifetime -= time.Duration(age) * time.Second
+		}
+		a.Expires = now.Add(lifetime)
+		return true
+	}
+
+	// Fallback to Expires header, which relative to the server's Date
+	if expires := header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			// Invalid Expires means it's already expired
+			a.Expires = now
+			return true
+		}
+
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+
+		a.Expires = now.Add(expiresAt.Sub(date))
+		return true
+	}
+
+	// If there are no explicit lifetime, guess it using Last-Modified
+	if a.LastModified != "" {
+		lastModified, err := http.ParseTime(a.LastModified)
+		if err == nil && lastModified.Before(now) {
+			lifetime := now.Sub(lastModified) / 10
+			if lifetime > maxHeuristicLifetime {
+				lifetime = maxHeuristicLifetime
+			}
+			a.Expires = now.Add(lifetime)
+		}
+	}
+
+	// Otherwise keep it for a short while, so it's not fetched again
+	// and again within the same archival, yet not kept forever either
+	if a.Expires.IsZero() {
+		a.Expires = now.Add(defaultLifetime)
+	}
+
+	return true
+}
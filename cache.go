@@ -0,0 +1,113 @@
+package obelisk
+
+import (
+	"container/list"
+	"sync"
+)
+
+// AssetCache is storage for assets that already downloaded, so the same
+// resource doesn't have to be downloaded more than once. Implementation
+// must be safe for concurrent use.
+type AssetCache interface {
+	// Get returns the asset which cached for the specified URL.
+	Get(url string) (Asset, bool)
+
+	// Put saves the asset for the specified URL, replacing the old one if exists.
+	Put(url string, asset Asset)
+
+	// Delete removes the asset for the specified URL from cache.
+	Delete(url string)
+}
+
+// MemoryCache is an in-memory AssetCache that evicts the least recently
+// used assets when size of the cached data exceeds its limit.
+type MemoryCache struct {
+	mutex   sync.Mutex
+	maxSize int64
+	size    int64
+	items   map[string]*list.Element
+	lru     *list.List
+}
+
+type memoryCacheEntry struct {
+	url   string
+	asset Asset
+}
+
+// NewMemoryCache returns a new MemoryCache which holds at most maxSize bytes
+// of asset data. If maxSize is zero or negative, the cache is unbounded.
+func NewMemoryCache(maxSize int64) *MemoryCache {
+	return &MemoryCache{
+		maxSize: maxSize,
+		items:   make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Get returns the asset which cached for the specified URL and mark it
+// as the most recently used.
+func (c *MemoryCache) Get(url string) (Asset, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, exist := c.items[url]
+	if !exist {
+		return Asset{}, false
+	}
+
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*memoryCacheEntry).asset, true
+}
+
+// Put saves the asset for the specified URL. If the asset is bigger than
+// the cache limit, it will not be saved.
+func (c *MemoryCache) Put(url string, asset Asset) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.remove(url)
+
+	assetSize := int64(len(asset.Data))
+	if c.maxSize > 0 && assetSize > c.maxSize {
+		return
+	}
+
+	entry := &memoryCacheEntry{url: url, asset: asset}
+	c.items[url] = c.lru.PushFront(entry)
+	c.size += assetSize
+
+	// Evict the least recently used assets until we are inside the limit
+	for c.maxSize > 0 && c.size > c.maxSize {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			break
+		}
+		c.remove(oldest.Value.(*memoryCacheEntry).url)
+	}
+}
+
+// Delete removes the asset for the specified URL from cache.
+func (c *MemoryCache) Delete(url string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.remove(url)
+}
+
+// Size returns the total size of asset data that currently cached.
+func (c *MemoryCache) Size() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.size
+}
+
+// remove deletes entry for the URL. Caller must hold the mutex.
+func (c *MemoryCache) remove(url string) {
+	elem, exist := c.items[url]
+	if !exist {
+		return
+	}
+
+	entry := c.lru.Remove(elem).(*memoryCacheEntry)
+	delete(c.items, url)
+	c.size -= int64(len(entry.asset.Data))
+}
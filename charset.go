@@ -0,0 +1,136 @@
+package obelisk
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gogs/chardet"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// sniffSize is the number of bytes that used to detect the encoding.
+const sniffSize = 8192
+
+// newHTMLDecoder returns reader that decodes HTML document into UTF-8. The
+// encoding is decided from BOM, charset in content type and meta tag. If the
+// document doesn't declare it, the encoding is guessed from its content.
+func newHTMLDecoder(r io.Reader, contentType string) (io.Reader, error) {
+	br, prefix, err := peekPrefix(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without declared charset, DetermineEncoding falls back to windows-1252
+	enc, name, certain := charset.DetermineEncoding(prefix, contentType)
+	if !certain && name == "windows-1252" {
+		enc = sniffEncoding(prefix)
+	}
+
+	return newDecoder(br, enc), nil
+}
+
+// newCSSDecoder returns reader that decodes stylesheet into UTF-8. Following
+// CSS Syntax spec, the encoding is decided from BOM, charset in content type,
+// then @charset rule. If the stylesheet doesn't declare it, the encoding is
+// guessed from its content.
+func newCSSDecoder(r io.Reader, contentType string) (io.Reader, error) {
+	br, prefix, err := peekPrefix(r)
+	if err != nil {
+		return nil, err
+	}
+
+	enc := cssEncoding(prefix, contentType)
+	if enc == nil {
+		enc = sniffEncoding(prefix)
+	}
+
+	return newDecoder(br, enc), nil
+}
+
+// peekPrefix returns the first bytes of reader without consuming them.
+func peekPrefix(r io.Reader) (*bufio.Reader, []byte, error) {
+	br := bufio.NewReaderSize(r, sniffSize)
+	prefix, err := br.Peek(sniffSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, nil, err
+	}
+	return br, prefix, nil
+}
+
+// newDecoder returns reader that decodes the encoding into UTF-8. BOM takes
+// precedence over the encoding, and it's removed from the result.
+func newDecoder(r io.Reader, enc encoding.Encoding) io.Reader {
+	return transform.NewReader(r, unicode.BOMOverride(enc.NewDecoder()))
+}
+
+// cssEncoding returns the encoding declared by the stylesheet, or nil if
+// there are none.
+func cssEncoding(prefix []byte, contentType string) encoding.Encoding {
+	switch {
+	case bytes.HasPrefix(prefix, []byte{0xEF, 0xBB, 0xBF}):
+		return unicode.UTF8
+	case bytes.HasPrefix(prefix, []byte{0xFE, 0xFF}):
+		return unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM)
+	case bytes.HasPrefix(prefix, []byte{0xFF, 0xFE}):
+		return unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM)
+	}
+
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		if enc, _ := charset.Lookup(params["charset"]); enc != nil {
+			return enc
+		}
+	}
+
+	// @charset must be written exactly at the start of stylesheet
+	const charsetRule = `@charset "`
+	if bytes.HasPrefix(prefix, []byte(charsetRule)) {
+		label := prefix[len(charsetRule):]
+		if end := bytes.Index(label, []byte(`";`)); end >= 0 {
+			enc, name := charset.Lookup(string(label[:end]))
+			if strings.HasPrefix(name, "utf-16") {
+				return unicode.UTF8
+			}
+			if enc != nil {
+				return enc
+			}
+		}
+	}
+
+	return nil
+}
+
+// sniffEncoding guesses the encoding of content from its first bytes.
+func sniffEncoding(prefix []byte) encoding.Encoding {
+	// Remove partial rune at the end before validating UTF-8
+	trimmed := prefix
+	for i := len(trimmed) - 1; i >= 0 && i > len(trimmed)-utf8.UTFMax; i-- {
+		if trimmed[i] < utf8.RuneSelf {
+			break
+		}
+		if utf8.RuneStart(trimmed[i]) {
+			trimmed = trimmed[:i]
+			break
+		}
+	}
+
+	if utf8.Valid(trimmed) {
+		return unicode.UTF8
+	}
+
+	if result, err := chardet.NewTextDetector().DetectBest(prefix); err == nil {
+		if enc, _ := charset.Lookup(result.Charset); enc != nil {
+			return enc
+		}
+	}
+
+	return charmap.Windows1252
+}
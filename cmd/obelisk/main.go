@@ -4,17 +4,21 @@ import (
 	"compress/gzip"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	nurl "net/url"
 	"os"
+	"os/signal"
 	fp "path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/go-shiori/obelisk"
-	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
@@ -34,27 +38,49 @@ func main() {
 	cmd.Flags().StringP("input", "i", "", "path to file which contains URLs")
 	cmd.Flags().StringP("output", "o", "", "path to save archival result")
 	cmd.Flags().StringP("load-cookies", "c", "", "path to Netscape cookie file")
+	cmd.Flags().String("save-cookies", "", "save cookies into Netscape cookie file after archival")
+	cmd.Flags().Bool("netrc", false, "use credentials from ~/.netrc for HTTP authentication")
+	cmd.Flags().String("netrc-file", "", "path to .netrc file for HTTP authentication")
+	cmd.Flags().String("cache-dir", "", "directory to cache downloaded assets across runs")
 
 	cmd.Flags().StringP("user-agent", "u", "", "set custom user agent")
+	cmd.Flags().StringArrayP("header", "H", nil, "add header to every request, e.g. 'Accept-Language: en'")
+	cmd.Flags().StringArray("host-header", nil, "add header to requests for a host, e.g. 'example.com=Authorization: Bearer token'")
 	cmd.Flags().BoolP("gzip", "z", false, "gzip archival result")
 	cmd.Flags().BoolP("quiet", "q", false, "disable logging")
 	cmd.Flags().Bool("verbose", false, "more verbose logging")
+	cmd.Flags().String("log-format", "text", "log format, either text or json")
 
 	cmd.Flags().Bool("no-js", false, "disable JavaScript")
 	cmd.Flags().Bool("no-css", false, "disable CSS styling")
 	cmd.Flags().Bool("no-embeds", false, "remove embedded elements (e.g iframe)")
 	cmd.Flags().Bool("no-medias", false, "remove media elements (e.g img, audio)")
+	cmd.Flags().StringSlice("skip-host", nil, "keep resources from these hosts as remote URL")
+	cmd.Flags().StringSlice("skip-url", nil, "keep resources whose URL matches these regexes as remote URL")
+	cmd.Flags().StringSlice("skip-kind", nil, "keep resources of these kinds (image, video, audio, font, stylesheet, script, frame) as remote URL")
+	cmd.Flags().String("rules", "", "path to file which contains resource filter rules")
+	cmd.Flags().String("max-resource-size", "", "keep resources larger than this (e.g. 5MB) as remote URL")
+	cmd.Flags().String("max-archive-size", "", "maximum total size of resources embedded in an archive (e.g. 50MB)")
 
 	cmd.Flags().IntP("retries", "r", 3, "maximum number of retries for single request")
 	cmd.Flags().IntP("timeout", "t", 60, "maximum time (in second) before request timeout")
+	cmd.Flags().Int("archive-timeout", 0, "maximum time (in second) to archive a single URL, 0 means no limit")
 	cmd.Flags().Bool("insecure", false, "skip X.509 (TLS) certificate verification")
+	cmd.Flags().String("ca-cert", "", "path to PEM file of additional certificate authorities to trust")
+	cmd.Flags().String("cert", "", "path to PEM file of client certificate for mutual TLS")
+	cmd.Flags().String("key", "", "path to PEM file of private key for client certificate, if it's not in --cert")
+	cmd.Flags().StringArray("resolve", nil, "connect to the address for host and port, e.g. 'example.com:443:127.0.0.1'")
+	cmd.Flags().String("proxy", "", "proxy for every request, e.g. socks5h://127.0.0.1:9050")
+	cmd.Flags().StringArray("proxy-rule", nil, "proxy for requests to some hosts, e.g. 'onion=socks5h://127.0.0.1:9050' or 'example.com=direct'")
 	cmd.Flags().Int64("max-concurrent-download", 10, "max concurrent download at a time")
+	cmd.Flags().Int64("max-concurrent-per-host", 0, "max concurrent download from a single host, 0 means no limit")
+	cmd.Flags().Float64("host-rate-limit", 0, "max requests per second sent to a single host, 0 means no limit")
 	cmd.Flags().Bool("skip-resource-url-error", false, "skip process resource url error")
 
 	// Execute
 	err := cmd.Execute()
 	if err != nil {
-		logrus.Fatalln(err)
+		os.Exit(1)
 	}
 }
 
@@ -64,23 +90,68 @@ func cmdHandler(cmd *cobra.Command, args []string) error {
 	inputPath, _ := cmd.Flags().GetString("input")
 	outputPath, _ := cmd.Flags().GetString("output")
 	cookiesFilePath, _ := cmd.Flags().GetString("load-cookies")
+	saveCookiesPath, _ := cmd.Flags().GetString("save-cookies")
+	useNetrc, _ := cmd.Flags().GetBool("netrc")
+	netrcPath, _ := cmd.Flags().GetString("netrc-file")
+	cacheDir, _ := cmd.Flags().GetString("cache-dir")
 
 	userAgent, _ := cmd.Flags().GetString("user-agent")
+	headerValues, _ := cmd.Flags().GetStringArray("header")
+	hostHeaderValues, _ := cmd.Flags().GetStringArray("host-header")
 	useGzip, _ := cmd.Flags().GetBool("gzip")
 	disableLog, _ := cmd.Flags().GetBool("quiet")
 	useVerboseLog, _ := cmd.Flags().GetBool("verbose")
+	logFormat, _ := cmd.Flags().GetString("log-format")
 
 	disableJS, _ := cmd.Flags().GetBool("no-js")
 	disableCSS, _ := cmd.Flags().GetBool("no-css")
 	disableEmbeds, _ := cmd.Flags().GetBool("no-embeds")
 	disableMedias, _ := cmd.Flags().GetBool("no-medias")
+	skipHosts, _ := cmd.Flags().GetStringSlice("skip-host")
+	skipURLs, _ := cmd.Flags().GetStringSlice("skip-url")
+	skipKinds, _ := cmd.Flags().GetStringSlice("skip-kind")
+	rulesPath, _ := cmd.Flags().GetString("rules")
+	maxResourceSize, _ := cmd.Flags().GetString("max-resource-size")
+	maxArchiveSize, _ := cmd.Flags().GetString("max-archive-size")
 
 	retries, _ := cmd.Flags().GetInt("retries")
 	timeout, _ := cmd.Flags().GetInt("timeout")
+	archiveTimeout, _ := cmd.Flags().GetInt("archive-timeout")
 	skipTLSVerification, _ := cmd.Flags().GetBool("insecure")
+	caCertPath, _ := cmd.Flags().GetString("ca-cert")
+	certPath, _ := cmd.Flags().GetString("cert")
+	keyPath, _ := cmd.Flags().GetString("key")
+	resolveValues, _ := cmd.Flags().GetStringArray("resolve")
+	proxy, _ := cmd.Flags().GetString("proxy")
+	proxyRuleValues, _ := cmd.Flags().GetStringArray("proxy-rule")
 	maxConcurrentDownload, _ := cmd.Flags().GetInt64("max-concurrent-download")
+	maxConcurrentPerHost, _ := cmd.Flags().GetInt64("max-concurrent-per-host")
+	hostRateLimit, _ := cmd.Flags().GetFloat64("host-rate-limit")
 	skipResourceURLError, _ := cmd.Flags().GetBool("skip-resource-url-error")
 
+	// Prepare logger
+	logOptions := &slog.HandlerOptions{Level: slog.LevelInfo}
+	if useVerboseLog {
+		logOptions.Level = slog.LevelDebug
+	}
+
+	var logHandler slog.Handler
+	switch logFormat {
+	case "text":
+		logHandler = slog.NewTextHandler(os.Stderr, logOptions)
+	case "json":
+		logHandler = slog.NewJSONHandler(os.Stderr, logOptions)
+	default:
+		return fmt.Errorf("unknown log format: %s", logFormat)
+	}
+
+	logger := slog.New(logHandler)
+
+	var archiverLogger obelisk.Logger
+	if !disableLog {
+		archiverLogger = logger
+	}
+
 	// Prepare output target
 	outputDir := ""
 	outputFileName := ""
@@ -126,43 +197,223 @@ func cmdHandler(cmd *cobra.Command, args []string) error {
 		useStdout = false
 	}
 
-	// Read cookies file
-	cookiesMap := make(map[string][]*http.Cookie)
+	// Read cookies file. The jar is shared by every URLs, so cookies that set
+	// while archiving a page are also used for the next pages.
+	cookieJar := obelisk.NewCookieJar()
 	if cookiesFilePath != "" {
-		cookiesMap, err = parseCookiesFile(cookiesFilePath)
+		if err = cookieJar.LoadCookiesFile(cookiesFilePath); err != nil {
+			return err
+		}
+	}
+
+	// Prepare filter rules. Rules from file are checked first.
+	var filterRules []obelisk.FilterRule
+	if rulesPath != "" {
+		filterRules, err = parseRulesFile(rulesPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(skipHosts) > 0 {
+		filterRules = append(filterRules, obelisk.FilterRule{Hosts: skipHosts})
+	}
+
+	for _, skipURL := range skipURLs {
+		rx, err := regexp.Compile(skipURL)
+		if err != nil {
+			return err
+		}
+		filterRules = append(filterRules, obelisk.FilterRule{URLPattern: rx})
+	}
+
+	if len(skipKinds) > 0 {
+		rule := obelisk.FilterRule{}
+		for _, name := range skipKinds {
+			kind, err := parseResourceKind(name)
+			if err != nil {
+				return fmt.Errorf("invalid skip kind: %w", err)
+			}
+			rule.Kinds = append(rule.Kinds, kind)
+		}
+		filterRules = append(filterRules, rule)
+	}
+
+	// Prepare size limits
+	var resourceSizeLimit, archiveSizeLimit int64
+	if maxResourceSize != "" {
+		resourceSizeLimit, err = parseByteSize(maxResourceSize)
+		if err != nil {
+			return fmt.Errorf("invalid max resource size: %w", err)
+		}
+	}
+
+	if maxArchiveSize != "" {
+		archiveSizeLimit, err = parseByteSize(maxArchiveSize)
+		if err != nil {
+			return fmt.Errorf("invalid max archive size: %w", err)
+		}
+	}
+
+	// Prepare TLS configuration
+	var rootCAs *x509.CertPool
+	if caCertPath != "" {
+		rootCAs, err = loadCertPool(caCertPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	var clientCerts []tls.Certificate
+	if certPath != "" {
+		if keyPath == "" {
+			keyPath = certPath
+		}
+
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		clientCerts = append(clientCerts, cert)
+	}
+
+	resolveOverrides := make(map[string]string)
+	for _, text := range resolveValues {
+		hostPort, address, err := parseResolve(text)
+		if err != nil {
+			return err
+		}
+		resolveOverrides[hostPort] = address
+	}
+
+	// Prepare proxies. Host rules are checked first, then the default proxy.
+	var proxies []obelisk.ProxyRule
+	for _, text := range proxyRuleValues {
+		hosts, proxyText, found := strings.Cut(text, "=")
+		if !found || strings.TrimSpace(hosts) == "" {
+			return fmt.Errorf("invalid proxy rule %q: host is not specified", text)
+		}
+
+		proxyURL, err := obelisk.ParseProxyURL(proxyText)
+		if err != nil {
+			return fmt.Errorf("invalid proxy rule %q: %w", text, err)
+		}
+
+		rule := obelisk.ProxyRule{URL: proxyURL}
+		for _, host := range strings.Split(hosts, ",") {
+			rule.Hosts = append(rule.Hosts, strings.TrimSpace(host))
+		}
+		proxies = append(proxies, rule)
+	}
+
+	if proxy != "" {
+		proxyURL, err := obelisk.ParseProxyURL(proxy)
+		if err != nil {
+			return fmt.Errorf("invalid proxy: %w", err)
+		}
+		proxies = append(proxies, obelisk.ProxyRule{URL: proxyURL})
+	}
+
+	// Read credentials from .netrc. Like curl, missing ~/.netrc is ignored.
+	var credentials map[string]obelisk.Credential
+	switch {
+	case netrcPath != "":
+		credentials, err = obelisk.LoadNetrcFile(netrcPath)
+		if err != nil {
+			return err
+		}
+
+	case useNetrc:
+		homeDir, err := os.UserHomeDir()
 		if err != nil {
 			return err
 		}
+
+		credentials, err = obelisk.LoadNetrcFile(fp.Join(homeDir, ".netrc"))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
 	}
 
-	transport := http.DefaultTransport.(*http.Transport).Clone()
-	if skipTLSVerification {
-		transport.TLSClientConfig = &tls.Config{
-			InsecureSkipVerify: skipTLSVerification, //nolint:gosec
+	// Prepare custom headers
+	header := http.Header{}
+	for _, text := range headerValues {
+		key, value, err := parseHeader(text)
+		if err != nil {
+			return err
+		}
+		header.Add(key, value)
+	}
+
+	hostHeaders := make(map[string]http.Header)
+	for _, text := range hostHeaderValues {
+		host, headerText, found := strings.Cut(text, "=")
+		if !found || strings.TrimSpace(host) == "" {
+			return fmt.Errorf("invalid host header %q: host is not specified", text)
+		}
+
+		key, value, err := parseHeader(headerText)
+		if err != nil {
+			return err
+		}
+
+		host = strings.TrimSpace(host)
+		if hostHeaders[host] == nil {
+			hostHeaders[host] = http.Header{}
+		}
+		hostHeaders[host].Add(key, value)
+	}
+
+	// Prepare persistent cache if needed
+	var cache obelisk.AssetCache
+	if cacheDir != "" {
+		cache, err = obelisk.NewDiskCache(cacheDir)
+		if err != nil {
+			return err
 		}
 	}
 
 	// Create archiver
 	archiver := obelisk.Archiver{
-		Cache: make(map[string]obelisk.Asset),
+		Cache:     cache,
+		CookieJar: cookieJar,
 
-		UserAgent:        userAgent,
-		EnableLog:        !disableLog,
-		EnableVerboseLog: !disableLog && useVerboseLog,
+		UserAgent:   userAgent,
+		Header:      header,
+		HostHeaders: hostHeaders,
+		Credentials: credentials,
+		Logger:      archiverLogger,
 
 		DisableJS:     disableJS,
 		DisableCSS:    disableCSS,
 		DisableEmbeds: disableEmbeds,
 		DisableMedias: disableMedias,
+		FilterRules:   filterRules,
+
+		MaxResourceSize: resourceSizeLimit,
+		MaxArchiveSize:  archiveSizeLimit,
 
-		Transport:             transport,
 		MaxRetries:            retries,
 		RequestTimeout:        time.Duration(timeout) * time.Second,
+		ArchiveTimeout:        time.Duration(archiveTimeout) * time.Second,
 		MaxConcurrentDownload: maxConcurrentDownload,
 		SkipResourceURLError:  skipResourceURLError,
+
+		MaxConcurrentPerHost: maxConcurrentPerHost,
+		HostRateLimit:        hostRateLimit,
+
+		Proxies:            proxies,
+		InsecureSkipVerify: skipTLSVerification,
+		RootCAs:            rootCAs,
+		ClientCertificates: clientCerts,
+		ResolveOverrides:   resolveOverrides,
 	}
 	archiver.Validate()
 
+	// Stop the archival when interrupted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	// Process each url
 	finishedURLs := make(map[string]struct{})
 
@@ -176,71 +427,83 @@ func cmdHandler(cmd *cobra.Command, args []string) error {
 			// Validate URL
 			url, err := nurl.ParseRequestURI(request.URL)
 			if err != nil || url.Scheme == "" || url.Hostname() == "" {
-				logrus.Warnf("%s is not valid URL\n", request.URL)
+				logger.Warn("url is not valid", "url", request.URL)
 				return nil
 			}
 
 			// Create request
-			var reqCookies []*http.Cookie
-			if len(cookiesMap) != 0 {
-				parts := strings.Split(url.Hostname(), ".")
-				for i := 0; i < len(parts)-1; i++ {
-					domainName := strings.Join(parts[i:], ".")
-					reqCookies = append(reqCookies, cookiesMap[domainName]...)
-					reqCookies = append(reqCookies, cookiesMap["."+domainName]...)
-				}
-			}
-
-			req := obelisk.Request{
-				URL: url.String(),
-			}
+			req := obelisk.Request{URL: url.String()}
 
 			// Start archival
 			if !disableLog || len(requests) > 1 {
-				logrus.Printf("archival started for %s\n", request.URL)
-			}
-
-			result, contentType, err := archiver.WithCookies(reqCookies).Archive(context.Background(), req)
-			if err != nil {
-				return err
+				logger.Info("archival started", "url", request.URL)
 			}
 
-			// Prepare output
+			// Prepare output. Since the file name might depend on the content
+			// type, the result is streamed into a temporary file first.
+			var f *os.File
 			var output io.Writer
 			if useStdout {
 				output = os.Stdout
 			} else {
-				fileName := request.FileName
-				if fileName == "" {
-					fileName = createFileName(url, contentType)
-					if useGzip {
-						fileName += ".gz"
-					}
+				tmpDir := outputDir
+				if tmpDir == "" {
+					tmpDir = "."
 				}
 
-				f, err := os.Create(fp.Join(outputDir, fileName))
+				f, err = os.CreateTemp(tmpDir, ".obelisk-*")
 				if err != nil {
 					return err
 				}
+				defer os.Remove(f.Name())
 				defer f.Close()
 
 				output = f
 			}
 
 			// Create gzip if needed
+			var gz *gzip.Writer
 			if useGzip {
-				gz := gzip.NewWriter(output)
-				defer gz.Close()
+				gz = gzip.NewWriter(output)
 				output = gz
 			}
 
-			_, err = output.Write(result)
+			result, err := archiver.ArchiveTo(ctx, req, output)
 			if err != nil {
 				return err
 			}
 
+			if gz != nil {
+				if err = gz.Close(); err != nil {
+					return err
+				}
+			}
+
+			// Move the result to its final path
+			if f != nil {
+				fileName := request.FileName
+				if fileName == "" {
+					fileName = createFileName(url, result.ContentType)
+					if useGzip {
+						fileName += ".gz"
+					}
+				}
+
+				if err = f.Chmod(0644); err != nil {
+					return err
+				}
+
+				if err = f.Close(); err != nil {
+					return err
+				}
+
+				if err = os.Rename(f.Name(), fp.Join(outputDir, fileName)); err != nil {
+					return err
+				}
+			}
+
 			if !disableLog || len(requests) > 1 {
-				logrus.Printf("archival finished for %s\n", request.URL)
+				logger.Info("archival finished", "url", request.URL)
 			}
 
 			finishedURLs[request.URL] = struct{}{}
@@ -248,14 +511,26 @@ func cmdHandler(cmd *cobra.Command, args []string) error {
 		}()
 
 		if err != nil {
-			logrus.Warnln(err)
+			logger.Warn("archival failed", "url", request.URL, "error", err)
+		}
+
+		// Don't process the rest of URLs once interrupted
+		if ctx.Err() != nil {
+			break
 		}
 
 		// Create blank space separator to make it easier to see logs
-		if !disableLog {
+		if !disableLog && logFormat == "text" {
 			fmt.Println()
 		}
 	}
 
-	return nil
+	// Save cookies, including the ones set while archiving
+	if saveCookiesPath != "" {
+		if err := cookieJar.SaveCookiesFile(saveCookiesPath); err != nil {
+			return err
+		}
+	}
+
+	return ctx.Err()
 }
@@ -2,15 +2,19 @@ package main
 
 import (
 	"bufio"
+	"crypto/x509"
 	"fmt"
 	"mime"
-	"net/http"
+	"net"
 	nurl "net/url"
 	"os"
 	pth "path"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/go-shiori/obelisk"
 )
 
 func parseInputFile(path string) ([]archiveRequest, error) {
@@ -43,7 +47,7 @@ func parseInputFile(path string) ([]archiveRequest, error) {
 	return results, nil
 }
 
-func parseCookiesFile(path string) (map[string][]*http.Cookie, error) {
+func parseRulesFile(path string) ([]obelisk.FilterRule, error) {
 	// Open file
 	f, err := os.Open(path)
 	if err != nil {
@@ -51,37 +55,167 @@ func parseCookiesFile(path string) (map[string][]*http.Cookie, error) {
 	}
 	defer f.Close()
 
-	// Create map to store cookies
-	mapCookies := make(map[string][]*http.Cookie)
-
-	// Create scanner
+	// Parse each line as a rule, skipping empty lines and comments
+	rules := []obelisk.FilterRule{}
 	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		parts := strings.Split(scanner.Text(), "\t")
-		if len(parts) != 7 {
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
 			continue
 		}
 
-		httpOnly := strings.HasPrefix(parts[0], "#HttpOnly_")
-		unixTime, _ := strconv.ParseInt(parts[4], 10, 64)
-		domainName := parts[0]
+		rule, err := parseFilterRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+// parseHeader parses header which looks like `Name: value`.
+func parseHeader(text string) (string, string, error) {
+	key, value, found := strings.Cut(text, ":")
+	key = strings.TrimSpace(key)
+	if !found || key == "" || strings.ContainsAny(key, " \t") {
+		return "", "", fmt.Errorf("invalid header %q", text)
+	}
+
+	return key, strings.TrimSpace(value), nil
+}
+
+// parseResolve parses resolve override which looks like `host:port:address`.
+func parseResolve(text string) (string, string, error) {
+	parts := strings.SplitN(text, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return "", "", fmt.Errorf("invalid resolve %q, must be host:port:address", text)
+	}
+
+	if _, err := strconv.ParseUint(parts[1], 10, 16); err != nil {
+		return "", "", fmt.Errorf("invalid resolve %q: invalid port", text)
+	}
+
+	address := strings.Trim(parts[2], "[]")
+	if net.ParseIP(address) == nil {
+		return "", "", fmt.Errorf("invalid resolve %q: invalid IP address", text)
+	}
+
+	return net.JoinHostPort(parts[0], parts[1]), address, nil
+}
+
+// loadCertPool loads PEM certificates in the path, in addition to the
+// system's certificate authorities.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pemCerts, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(pemCerts) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// parseFilterRule parses rule which looks like `skip host=a.com,b.com kind=image larger=2MB`.
+func parseFilterRule(text string) (obelisk.FilterRule, error) {
+	var rule obelisk.FilterRule
+
+	fields := strings.Fields(text)
+	switch fields[0] {
+	case "skip":
+		rule.Action = obelisk.FilterSkip
+	case "allow":
+		rule.Action = obelisk.FilterAllow
+	default:
+		return rule, fmt.Errorf("unknown action %q", fields[0])
+	}
+
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		if value == "" {
+			return rule, fmt.Errorf("condition %q has no value", field)
+		}
+
+		switch key {
+		case "host":
+			rule.Hosts = strings.Split(value, ",")
+		case "url":
+			rx, err := regexp.Compile(value)
+			if err != nil {
+				return rule, err
+			}
+			rule.URLPattern = rx
+		case "kind":
+			for _, name := range strings.Split(value, ",") {
+				kind, err := parseResourceKind(name)
+				if err != nil {
+					return rule, err
+				}
+				rule.Kinds = append(rule.Kinds, kind)
+			}
+		case "larger":
+			size, err := parseByteSize(value)
+			if err != nil {
+				return rule, err
+			}
+			rule.LargerThan = size
+		default:
+			return rule, fmt.Errorf("unknown condition %q", key)
+		}
+	}
+
+	return rule, nil
+}
 
-		if httpOnly {
-			domainName = strings.TrimPrefix(domainName, "#HttpOnly_")
+// parseResourceKind parses the name of resource kind, e.g. `image` or `font`.
+func parseResourceKind(name string) (obelisk.ResourceKind, error) {
+	kind := obelisk.ResourceKind(strings.ToLower(strings.TrimSpace(name)))
+	switch kind {
+	case obelisk.KindImage, obelisk.KindVideo, obelisk.KindAudio, obelisk.KindFont,
+		obelisk.KindStylesheet, obelisk.KindScript, obelisk.KindFrame:
+		return kind, nil
+	default:
+		return "", fmt.Errorf("unknown resource kind %q", name)
+	}
+}
+
+// parseByteSize parses size like `512`, `100KB` or `2MB` into bytes.
+func parseByteSize(s string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+
+	str := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(str, unit.suffix) {
+			str = strings.TrimSuffix(str, unit.suffix)
+			multiplier = unit.multiplier
+			break
 		}
+	}
 
-		mapCookies[domainName] = append(mapCookies[domainName], &http.Cookie{
-			Name:     parts[5],
-			Value:    parts[6],
-			Path:     parts[2],
-			Domain:   domainName,
-			Expires:  time.Unix(unixTime, 0),
-			Secure:   parts[3] == "TRUE",
-			HttpOnly: httpOnly,
-		})
+	value, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
 	}
 
-	return mapCookies, nil
+	return int64(value * float64(multiplier)), nil
 }
 
 func createFileName(url *nurl.URL, contentType string) string {
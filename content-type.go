@@ -0,0 +1,160 @@
+package obelisk
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net/http"
+	nurl "net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// extensionContentTypes is the content type of common web resources by their
+// file extension. It's checked before the system MIME table, which might not
+// have all of them.
+var extensionContentTypes = map[string]string{
+	".css":   "text/css",
+	".js":    "text/javascript",
+	".mjs":   "text/javascript",
+	".html":  "text/html",
+	".htm":   "text/html",
+	".xhtml": "application/xhtml+xml",
+	".svg":   "image/svg+xml",
+	".png":   "image/png",
+	".apng":  "image/apng",
+	".jpg":   "image/jpeg",
+	".jpeg":  "image/jpeg",
+	".gif":   "image/gif",
+	".webp":  "image/webp",
+	".avif":  "image/avif",
+	".bmp":   "image/bmp",
+	".ico":   "image/x-icon",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+	".eot":   "application/vnd.ms-fontobject",
+	".mp4":   "video/mp4",
+	".webm":  "video/webm",
+	".ogv":   "video/ogg",
+	".mp3":   "audio/mpeg",
+	".ogg":   "audio/ogg",
+	".oga":   "audio/ogg",
+	".wav":   "audio/wav",
+	".vtt":   "text/vtt",
+}
+
+// resolveContentType decides the content type of downloaded resource. The
+// content type from server is used, unless it's missing or too generic. In
+// that case it's guessed from the kind of element that refers the resource,
+// the file extension, then the content.
+func resolveContentType(header string, kind ResourceKind, u *nurl.URL, body *bufio.Reader) string {
+	mediaType, params, err := mime.ParseMediaType(header)
+	if err == nil && !isGenericMediaType(mediaType) {
+		return mime.FormatMediaType(mediaType, params)
+	}
+
+	// Keep the charset, since it's still needed to decode text content
+	if params == nil {
+		params = map[string]string{}
+	}
+	withParams := func(mediaType string) string {
+		if !strings.HasPrefix(mediaType, "text/") {
+			return mediaType
+		}
+		return mime.FormatMediaType(mediaType, params)
+	}
+
+	switch kind {
+	case KindStylesheet:
+		return withParams("text/css")
+	case KindScript:
+		return withParams("text/javascript")
+	}
+
+	if u != nil {
+		if ext := strings.ToLower(path.Ext(u.Path)); ext != "" {
+			if mediaType := extensionContentTypes[ext]; mediaType != "" {
+				return withParams(mediaType)
+			}
+			if mediaType, _, err := mime.ParseMediaType(mime.TypeByExtension(ext)); err == nil {
+				return withParams(mediaType)
+			}
+		}
+	}
+
+	if body != nil {
+		// DetectContentType only considers the first 512 bytes
+		prefix, _ := body.Peek(512)
+		mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(prefix))
+		switch {
+		case (mediaType == "text/xml" || mediaType == "text/plain") && bytes.Contains(prefix, []byte("<svg")):
+			return "image/svg+xml"
+		case !isGenericMediaType(mediaType):
+			return withParams(mediaType)
+		}
+	}
+
+	return withParams("text/plain")
+}
+
+// isGenericMediaType checks whether the media type doesn't tell the actual
+// type of content.
+func isGenericMediaType(mediaType string) bool {
+	switch mediaType {
+	case "", "text/plain", "application/octet-stream", "binary/octet-stream",
+		"application/unknown", "application/x-unknown-content-type":
+		return true
+	}
+	return false
+}
+
+// mediaTypeOf returns the media type of content type, without its parameters.
+func mediaTypeOf(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// withUTF8Charset replaces the charset of content type with UTF-8, for
+// text content that already decoded.
+func withUTF8Charset(contentType string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+
+	params["charset"] = "utf-8"
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// dataURLMediaType formats the content type for data URL, which doesn't
+// allow whitespace between its parameters.
+func dataURLMediaType(contentType string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ReplaceAll(contentType, " ", "")
+	}
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString(mediaType)
+	for _, name := range names {
+		param := mime.FormatMediaType("x/x", map[string]string{name: params[name]})
+		if param == "" {
+			continue
+		}
+		sb.WriteString(";")
+		sb.WriteString(strings.TrimPrefix(param, "x/x; "))
+	}
+	return sb.String()
+}
@@ -0,0 +1,270 @@
+package obelisk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	nurl "net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+const httpOnlyPrefix = "#HttpOnly_"
+
+// CookieJar is http.CookieJar that matches cookies following RFC 6265. Unlike
+// the jar in `net/http/cookiejar`, its cookies can be exported into Netscape
+// cookie file.
+type CookieJar struct {
+	jar *cookiejar.Jar
+
+	mutex   sync.Mutex
+	entries map[string]cookieEntry
+}
+
+// cookieEntry is the record of a cookie that stored in jar.
+type cookieEntry struct {
+	domain   string
+	hostOnly bool
+	path     string
+	secure   bool
+	httpOnly bool
+	expires  time.Time // zero for session cookie
+	name     string
+	value    string
+}
+
+// NewCookieJar creates a new empty cookie jar.
+func NewCookieJar() *CookieJar {
+	jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	return &CookieJar{
+		jar:     jar,
+		entries: make(map[string]cookieEntry),
+	}
+}
+
+// Cookies implements http.CookieJar.
+func (j *CookieJar) Cookies(u *nurl.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+// SetCookies implements http.CookieJar.
+func (j *CookieJar) SetCookies(u *nurl.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	now := time.Now()
+	for _, cookie := range cookies {
+		entry, ok := newCookieEntry(u, cookie, now)
+		if !ok {
+			continue
+		}
+
+		key := entry.domain + ";" + entry.path + ";" + entry.name
+		if !entry.expires.IsZero() && !entry.expires.After(now) {
+			delete(j.entries, key)
+		} else {
+			j.entries[key] = entry
+		}
+	}
+}
+
+// newCookieEntry creates the record of cookie that set by the URL. Returns
+// false if the cookie is rejected, in the same way as the underlying jar.
+func newCookieEntry(u *nurl.URL, cookie *http.Cookie, now time.Time) (cookieEntry, bool) {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return cookieEntry{}, false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	entry := cookieEntry{
+		domain:   host,
+		hostOnly: true,
+		path:     cookie.Path,
+		secure:   cookie.Secure,
+		httpOnly: cookie.HttpOnly,
+		expires:  cookie.Expires,
+		name:     cookie.Name,
+		value:    cookie.Value,
+	}
+
+	// Domain cookie must be set by the domain or its subdomain, and
+	// it can't be set for public suffix (e.g. "co.uk").
+	if domain := strings.ToLower(strings.TrimPrefix(cookie.Domain, ".")); domain != "" && domain != host {
+		if !strings.HasSuffix(host, "."+domain) || publicsuffix.List.PublicSuffix(domain) == domain {
+			return cookieEntry{}, false
+		}
+		entry.domain = domain
+		entry.hostOnly = false
+	} else if domain != "" {
+		entry.hostOnly = false
+	}
+
+	// Use default path if the path is not specified
+	if !strings.HasPrefix(entry.path, "/") {
+		entry.path = "/"
+		if i := strings.LastIndex(u.Path, "/"); i > 0 {
+			entry.path = u.Path[:i]
+		}
+	}
+
+	switch {
+	case cookie.MaxAge < 0:
+		entry.expires = now.Add(-time.Second)
+	case cookie.MaxAge > 0:
+		entry.expires = now.Add(time.Duration(cookie.MaxAge) * time.Second)
+	}
+
+	return entry, true
+}
+
+// LoadNetscapeCookies reads cookies in Netscape cookie file format, which
+// used by curl and browser extensions, into the jar.
+func (j *CookieJar) LoadNetscapeCookies(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Tab is not trimmed, since it separates the empty value in the end
+		line := strings.Trim(scanner.Text(), " \r\n")
+
+		httpOnly := strings.HasPrefix(line, httpOnlyPrefix)
+		if httpOnly {
+			line = strings.TrimPrefix(line, httpOnlyPrefix)
+		}
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// Skip invalid line, since each tool writes the file a bit differently
+		parts := strings.Split(line, "\t")
+		if len(parts) != 7 {
+			continue
+		}
+
+		unixTime, err := strconv.ParseInt(parts[4], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		domain := strings.TrimPrefix(parts[0], ".")
+		cookie := &http.Cookie{
+			Name:     parts[5],
+			Value:    parts[6],
+			Path:     parts[2],
+			Secure:   strings.EqualFold(parts[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+
+		if strings.EqualFold(parts[1], "TRUE") {
+			cookie.Domain = domain
+		}
+
+		if unixTime > 0 {
+			cookie.Expires = time.Unix(unixTime, 0)
+		}
+
+		scheme := "http"
+		if cookie.Secure {
+			scheme = "https"
+		}
+
+		j.SetCookies(&nurl.URL{Scheme: scheme, Host: domain, Path: cookie.Path}, []*http.Cookie{cookie})
+	}
+
+	return scanner.Err()
+}
+
+// SaveNetscapeCookies writes the cookies in jar in Netscape cookie file format.
+// Expired cookies are left out, while session cookies are saved without
+// expiration time.
+func (j *CookieJar) SaveNetscapeCookies(w io.Writer) error {
+	j.mutex.Lock()
+	entries := make([]cookieEntry, 0, len(j.entries))
+	now := time.Now()
+	for _, entry := range j.entries {
+		if entry.expires.IsZero() || entry.expires.After(now) {
+			entries = append(entries, entry)
+		}
+	}
+	j.mutex.Unlock()
+
+	sort.Slice(entries, func(a, b int) bool {
+		switch {
+		case entries[a].domain != entries[b].domain:
+			return entries[a].domain < entries[b].domain
+		case entries[a].path != entries[b].path:
+			return entries[a].path < entries[b].path
+		default:
+			return entries[a].name < entries[b].name
+		}
+	})
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# Netscape HTTP Cookie File")
+	for _, entry := range entries {
+		domain := entry.domain
+		includeSubdomains := "FALSE"
+		if !entry.hostOnly {
+			domain = "." + domain
+			includeSubdomains = "TRUE"
+		}
+
+		if entry.httpOnly {
+			domain = httpOnlyPrefix + domain
+		}
+
+		secure := "FALSE"
+		if entry.secure {
+			secure = "TRUE"
+		}
+
+		var expires int64
+		if !entry.expires.IsZero() {
+			expires = entry.expires.Unix()
+		}
+
+		fmt.Fprintf(bw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", domain, includeSubdomains,
+			entry.path, secure, expires, entry.name, entry.value)
+	}
+
+	return bw.Flush()
+}
+
+// LoadCookiesFile loads Netscape cookie file into the jar.
+func (j *CookieJar) LoadCookiesFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := j.LoadNetscapeCookies(f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// SaveCookiesFile saves the cookies in jar into Netscape cookie file.
+func (j *CookieJar) SaveCookiesFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err := j.SaveNetscapeCookies(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
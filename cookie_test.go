@@ -0,0 +1,115 @@
+package obelisk
+
+import (
+	"bytes"
+	"net/http"
+	nurl "net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// netscapeCookies is a cookie file with variations written by different tools.
+var netscapeCookies = strings.Join([]string{
+	"# Netscape HTTP Cookie File",
+	"# https://curl.se/docs/http-cookies.html",
+	"",
+	"example.com\tFALSE\t/\tFALSE\t0\thost\t1",
+	".example.com\tTRUE\t/\tFALSE\t4102444800\tdomain\t2",
+	"example.com\tFALSE\t/private\tFALSE\t0\tpath\t3",
+	"example.com\tFALSE\t/\tTRUE\t0\tsecure\t4",
+	"#HttpOnly_example.com\tFALSE\t/\tFALSE\t0\thttponly\t5",
+	"example.com\tFALSE\t/\tFALSE\t1\texpired\t6",
+	"  other.org\tFALSE\t/\tFALSE\t0\tother\t7  ",
+	"invalid line",
+	"example.com\tFALSE\t/\tFALSE\tnever\tbadtime\t8",
+	"example.com\tFALSE\t/\tFALSE\t0\tempty\t",
+}, "\n")
+
+func TestLoadNetscapeCookies(t *testing.T) {
+	jar := NewCookieJar()
+	if err := jar.LoadNetscapeCookies(strings.NewReader(netscapeCookies)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		url      string
+		expected string
+	}{{
+		url:      "http://example.com/",
+		expected: "domain=2; empty=; host=1; httponly=5",
+	}, {
+		url:      "https://example.com/",
+		expected: "domain=2; empty=; host=1; httponly=5; secure=4",
+	}, {
+		url:      "http://example.com/private/page",
+		expected: "domain=2; empty=; host=1; httponly=5; path=3",
+	}, {
+		url:      "http://sub.example.com/",
+		expected: "domain=2",
+	}, {
+		url:      "http://other.org/",
+		expected: "other=7",
+	}, {
+		url:      "http://unknown.net/",
+		expected: "",
+	}}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			u, _ := nurl.Parse(test.url)
+			if result := formatCookies(jar.Cookies(u)); result != test.expected {
+				t.Errorf("got %q, want %q", result, test.expected)
+			}
+		})
+	}
+}
+
+func TestSaveNetscapeCookies(t *testing.T) {
+	jar := NewCookieJar()
+	if err := jar.LoadNetscapeCookies(strings.NewReader(netscapeCookies)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var buffer bytes.Buffer
+	if err := jar.SaveNetscapeCookies(&buffer); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := strings.Join([]string{
+		"# Netscape HTTP Cookie File",
+		".example.com\tTRUE\t/\tFALSE\t4102444800\tdomain\t2",
+		"example.com\tFALSE\t/\tFALSE\t0\tempty\t",
+		"example.com\tFALSE\t/\tFALSE\t0\thost\t1",
+		"#HttpOnly_example.com\tFALSE\t/\tFALSE\t0\thttponly\t5",
+		"example.com\tFALSE\t/\tTRUE\t0\tsecure\t4",
+		"example.com\tFALSE\t/private\tFALSE\t0\tpath\t3",
+		"other.org\tFALSE\t/\tFALSE\t0\tother\t7",
+		"",
+	}, "\n")
+
+	if buffer.String() != expected {
+		t.Errorf("unexpected cookie file\n got: %q\nwant: %q", buffer.String(), expected)
+	}
+
+	// The saved file must be loaded back into the same cookies
+	loaded := NewCookieJar()
+	if err := loaded.LoadNetscapeCookies(&buffer); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	u, _ := nurl.Parse("https://example.com/private/")
+	if result, want := formatCookies(loaded.Cookies(u)), formatCookies(jar.Cookies(u)); result != want {
+		t.Errorf("got %q after reload, want %q", result, want)
+	}
+}
+
+// formatCookies joins the cookies sorted by their name.
+func formatCookies(cookies []*http.Cookie) string {
+	parts := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		parts = append(parts, cookie.Name+"="+cookie.Value)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "; ")
+}
@@ -19,18 +19,17 @@ func main() {
 	arc := obelisk.Archiver{EnableLog: true}
 	arc.Validate()
 
-	result, _, err := arc.Archive(context.Background(), req)
-	checkError(err)
-
 	// Create destination file
 	f, err := os.Create("globalwitness.html.gz")
 	checkError(err)
 	defer f.Close()
 
-	// Create gzipper
+	// Create gzipper, then stream the archive into it
 	gz := gzip.NewWriter(f)
-	gz.Write(result)
-	gz.Close()
+	defer gz.Close()
+
+	_, err = arc.ArchiveTo(context.Background(), req, gz)
+	checkError(err)
 }
 
 func checkError(err error) {
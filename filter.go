@@ -0,0 +1,163 @@
+package obelisk
+
+import (
+	"mime"
+	nurl "net/url"
+	"regexp"
+	"strings"
+)
+
+// ResourceKind is the kind of a resource. It's guessed from the element
+// that refers the resource, or from its content type.
+type ResourceKind string
+
+const (
+	KindUnknown    ResourceKind = ""
+	KindImage      ResourceKind = "image"
+	KindVideo      ResourceKind = "video"
+	KindAudio      ResourceKind = "audio"
+	KindFont       ResourceKind = "font"
+	KindStylesheet ResourceKind = "stylesheet"
+	KindScript     ResourceKind = "script"
+	KindFrame      ResourceKind = "frame"
+)
+
+// FilterAction is the action that taken for resource that matches a rule.
+type FilterAction int
+
+const (
+	// FilterSkip keeps the resource as remote URL instead of embedding it.
+	FilterSkip FilterAction = iota
+	// FilterAllow embeds the resource as usual.
+	FilterAllow
+)
+
+// FilterRule decides whether a resource should be embedded or kept as remote
+// URL. A rule matches a resource if all of its non-empty conditions match.
+// Rules are checked in order and the first matching rule is used. If there
+// are no matching rules, the resource will be embedded.
+type FilterRule struct {
+	Action FilterAction
+
+	// Hosts matches resource from the hosts, including their subdomains.
+	Hosts []string
+
+	// URLPattern matches resource whose URL matches the pattern.
+	URLPattern *regexp.Regexp
+
+	// Kinds matches resource with one of the kinds.
+	Kinds []ResourceKind
+
+	// LargerThan matches resource whose size is larger than it, in bytes.
+	LargerThan int64
+}
+
+// match checks whether the rule matches the resource. If it can't be
+// decided yet because the kind or size is unknown, decided will be false.
+// Unknown size is represented by negative value.
+func (rule FilterRule) match(url *nurl.URL, kind ResourceKind, size int64, final bool) (matched bool, decided bool) {
+	if len(rule.Hosts) > 0 && !matchHosts(url.Hostname(), rule.Hosts) {
+		return false, true
+	}
+
+	if rule.URLPattern != nil && !rule.URLPattern.MatchString(url.String()) {
+		return false, true
+	}
+
+	decided = true
+	if len(rule.Kinds) > 0 {
+		switch {
+		case kind != KindUnknown:
+			if !containsKind(rule.Kinds, kind) {
+				return false, true
+			}
+		case final:
+			return false, true
+		default:
+			decided = false
+		}
+	}
+
+	if rule.LargerThan > 0 {
+		switch {
+		case size >= 0:
+			if size <= rule.LargerThan {
+				return false, true
+			}
+		case final:
+			return false, true
+		default:
+			decided = false
+		}
+	}
+
+	return decided, decided
+}
+
+// filterResource checks the filter rules to see whether the resource should
+// be skipped. If final is false and the rules need information that not
+// known yet, it returns false for decided so it can be checked again later.
+func (arc *Archiver) filterResource(url *nurl.URL, kind ResourceKind, size int64, final bool) (skip bool, decided bool) {
+	for _, rule := range arc.FilterRules {
+		matched, ruleDecided := rule.match(url, kind, size, final)
+		if !ruleDecided {
+			return false, false
+		}
+
+		if matched {
+			return rule.Action == FilterSkip, true
+		}
+	}
+
+	return false, true
+}
+
+// resourceKindFromContentType guesses the kind of resource from its content type.
+func resourceKindFromContentType(contentType string) ResourceKind {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return KindUnknown
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		return KindImage
+	case strings.HasPrefix(mediaType, "video/"):
+		return KindVideo
+	case strings.HasPrefix(mediaType, "audio/"):
+		return KindAudio
+	case strings.HasPrefix(mediaType, "font/"),
+		strings.Contains(mediaType, "font-"):
+		return KindFont
+	case mediaType == "text/css":
+		return KindStylesheet
+	case strings.Contains(mediaType, "javascript"),
+		strings.Contains(mediaType, "ecmascript"):
+		return KindScript
+	case mediaType == "text/html":
+		return KindFrame
+	}
+
+	return KindUnknown
+}
+
+// matchHosts checks if host is one of the hosts or their subdomain.
+func matchHosts(host string, hosts []string) bool {
+	host = strings.ToLower(host)
+	for _, h := range hosts {
+		h = strings.ToLower(strings.TrimPrefix(h, "."))
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsKind(kinds []ResourceKind, kind ResourceKind) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
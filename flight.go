@@ -0,0 +1,90 @@
+package obelisk
+
+import (
+	"context"
+	"sync"
+)
+
+type ctxKeyFetchFlights struct{}
+
+func withFetchFlights(ctx context.Context, flights *fetchFlights) context.Context {
+	return context.WithValue(ctx, ctxKeyFetchFlights{}, flights)
+}
+
+func fetchFlightsFromContext(ctx context.Context) *fetchFlights {
+	if flights, ok := ctx.Value(ctxKeyFetchFlights{}).(*fetchFlights); ok {
+		return flights
+	}
+	return nil
+}
+
+// fetchFlights keeps the in-flight fetches in an archival, so concurrent
+// fetches of the same URL are coalesced into one.
+type fetchFlights struct {
+	sync.Mutex
+	flights map[string]*fetchFlight
+}
+
+func newFetchFlights() *fetchFlights {
+	return &fetchFlights{flights: make(map[string]*fetchFlight)}
+}
+
+// fetchFlight is a fetch of an URL that waited by other fetches.
+type fetchFlight struct {
+	done  chan struct{}
+	asset *Asset // set once the resource is fetched successfully
+	res   Resource
+	err   error
+}
+
+// join returns the in-flight fetch of the URL. If there is none, a new one is
+// started and leader will be true, in which case finish must be called once
+// the fetch is done.
+func (ff *fetchFlights) join(url string) (flight *fetchFlight, leader bool) {
+	if ff == nil {
+		return nil, true
+	}
+
+	ff.Lock()
+	defer ff.Unlock()
+
+	if flight, exist := ff.flights[url]; exist {
+		return flight, false
+	}
+
+	flight = &fetchFlight{done: make(chan struct{})}
+	ff.flights[url] = flight
+	return flight, true
+}
+
+// finish marks the fetch as done, and wakes up its waiters.
+func (ff *fetchFlights) finish(url string, flight *fetchFlight, res Resource, err error) {
+	if ff == nil {
+		return
+	}
+
+	ff.Lock()
+	delete(ff.flights, url)
+	ff.Unlock()
+
+	flight.res = res
+	flight.err = err
+	close(flight.done)
+}
+
+// share saves the fetched asset, so the waiters can use it.
+func (f *fetchFlight) share(asset Asset) {
+	if f != nil {
+		f.asset = &asset
+	}
+}
+
+// wait blocks until the fetch is done, or the context is done.
+func (f *fetchFlight) wait(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -3,23 +3,21 @@ module github.com/go-shiori/obelisk
 go 1.21
 
 require (
-	github.com/cenkalti/backoff/v4 v4.2.1
 	github.com/go-shiori/dom v0.0.0-20230515143342-73569d674e1c
+	github.com/gogs/chardet v0.0.0-20211120154057-b7413eaefb8f
 	github.com/kennygrant/sanitize v1.2.4
 	github.com/pkg/errors v0.9.1
-	github.com/sirupsen/logrus v1.9.3
 	github.com/spf13/cobra v1.8.0
 	github.com/tdewolff/parse/v2 v2.7.11
 	golang.org/x/net v0.20.0
 	golang.org/x/sync v0.6.0
+	golang.org/x/text v0.14.0
 )
 
 require (
 	github.com/andybalholm/cascadia v1.3.2 // indirect
-	github.com/gogs/chardet v0.0.0-20211120154057-b7413eaefb8f // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/stretchr/testify v1.8.4 // indirect
 	golang.org/x/sys v0.16.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
 )
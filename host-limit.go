@@ -0,0 +1,166 @@
+package obelisk
+
+import (
+	"context"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// hostLimiter limits the concurrent downloads and request rate for each host.
+// It's shared by every archival that uses the same archiver.
+type hostLimiter struct {
+	mutex         sync.Mutex
+	maxConcurrent int64
+	rate          float64
+	hosts         map[string]*hostLimit
+}
+
+type hostLimit struct {
+	semaphore *semaphore.Weighted
+	bucket    *tokenBucket
+	users     int // downloads that hold or wait for this limit
+}
+
+// newHostLimiter creates a new host limiter. Returns nil if there are no limits.
+func newHostLimiter(maxConcurrent int64, rate float64) *hostLimiter {
+	if maxConcurrent <= 0 && rate <= 0 {
+		return nil
+	}
+
+	return &hostLimiter{
+		maxConcurrent: maxConcurrent,
+		rate:          rate,
+		hosts:         make(map[string]*hostLimit),
+	}
+}
+
+// use returns the limit for the host, and function that must be called once
+// the limit is no longer used.
+func (hl *hostLimiter) use(host string) (*hostLimit, func()) {
+	host = strings.ToLower(host)
+
+	hl.mutex.Lock()
+	defer hl.mutex.Unlock()
+
+	limit, exist := hl.hosts[host]
+	if !exist {
+		hl.removeIdle(time.Now())
+
+		limit = &hostLimit{}
+		if hl.maxConcurrent > 0 {
+			limit.semaphore = semaphore.NewWeighted(hl.maxConcurrent)
+		}
+		if hl.rate > 0 {
+			limit.bucket = newTokenBucket(hl.rate)
+		}
+		hl.hosts[host] = limit
+	}
+
+	limit.users++
+	return limit, func() {
+		hl.mutex.Lock()
+		limit.users--
+		hl.mutex.Unlock()
+	}
+}
+
+// removeIdle removes the limits that not used by any download, and whose
+// bucket already refilled, so the hosts don't pile up in long-running
+// archiver. Recreating them later gives the same limit as keeping them.
+func (hl *hostLimiter) removeIdle(now time.Time) {
+	for host, limit := range hl.hosts {
+		if limit.users == 0 && (limit.bucket == nil || limit.bucket.isFull(now)) {
+			delete(hl.hosts, host)
+		}
+	}
+}
+
+// acquire takes a download slot for the host, blocking until it's available.
+// The returned function must be called to release the slot.
+func (hl *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	if hl == nil || hl.maxConcurrent <= 0 {
+		return func() {}, nil
+	}
+
+	limit, done := hl.use(host)
+	if err := limit.semaphore.Acquire(ctx, 1); err != nil {
+		done()
+		return nil, err
+	}
+
+	return func() {
+		limit.semaphore.Release(1)
+		done()
+	}, nil
+}
+
+// wait blocks until a request to the host is allowed by the rate limit.
+func (hl *hostLimiter) wait(ctx context.Context, host string) error {
+	if hl == nil || hl.rate <= 0 {
+		return nil
+	}
+
+	limit, done := hl.use(host)
+	defer done()
+	return limit.bucket.wait(ctx)
+}
+
+// tokenBucket is a rate limiter that allows `rate` requests per second,
+// with burst up to one second worth of requests.
+type tokenBucket struct {
+	mutex    sync.Mutex
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	capacity := math.Max(1, rate)
+	return &tokenBucket{
+		rate:     rate,
+		capacity: capacity,
+		tokens:   capacity,
+		last:     time.Now(),
+	}
+}
+
+// isFull checks whether the bucket is refilled up to its capacity.
+func (b *tokenBucket) isFull(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.capacity
+}
+
+func (b *tokenBucket) wait(ctx context.Context) error {
+	// Take a token in advance, then wait until the bucket is refilled
+	b.mutex.Lock()
+	now := time.Now()
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// Give back the unused token
+		b.mutex.Lock()
+		b.tokens = math.Min(b.capacity, b.tokens+1)
+		b.mutex.Unlock()
+		return ctx.Err()
+	}
+}
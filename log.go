@@ -1,21 +1,69 @@
 package obelisk
 
 import (
-	"github.com/sirupsen/logrus"
+	"log/slog"
+	"os"
 )
 
-func (arc *Archiver) logURL(url, parentURL string, isCached bool) {
-	if !arc.EnableLog {
-		return
-	}
+// Logger is the structured logger used by Archiver. It's compatible
+// with `*slog.Logger`, so it can be used directly.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+type nopLogger struct{}
 
-	fields := logrus.Fields{}
-	if isCached {
-		fields["cached"] = true
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// resolveLogger returns the logger that will be used by archiver. If custom
+// logger is not specified, it will log to stderr depending on `EnableLog`
+// and `EnableVerboseLog`.
+func (arc *Archiver) resolveLogger() Logger {
+	switch {
+	case arc.Logger != nil:
+		return arc.Logger
+	case !arc.EnableLog:
+		return nopLogger{}
 	}
+
+	level := slog.LevelInfo
 	if arc.EnableVerboseLog {
-		fields["parent"] = parentURL
+		level = slog.LevelDebug
 	}
 
-	logrus.WithFields(fields).Println(url)
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+}
+
+// logResource logs the final state of a resource.
+func (arc *Archiver) logResource(res Resource) {
+	args := []any{"url", res.URL, "parent", res.ParentURL}
+
+	switch res.Outcome {
+	case ResourceSkipped:
+		arc.logger.Debug("resource skipped", args...)
+
+	case ResourceTooLarge:
+		args = append(args, "error", res.Error)
+		arc.logger.Warn("resource too large", args...)
+
+	case ResourceFailed:
+		args = append(args, "error", res.Error)
+		if res.StatusCode != 0 {
+			args = append(args, "status", res.StatusCode)
+		}
+		arc.logger.Warn("resource failed", args...)
+
+	default:
+		args = append(args, "cached", res.Cached, "size", res.Size)
+		if res.StatusCode != 0 {
+			args = append(args, "status", res.StatusCode, "duration", res.Duration)
+		}
+		arc.logger.Info("resource processed", args...)
+	}
 }
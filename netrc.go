@@ -0,0 +1,104 @@
+package obelisk
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ParseNetrc parses credentials from .netrc file, mapped by host. The
+// credential of `default` entry is mapped to "*", so like curl it's only
+// used for the host of archived page.
+func ParseNetrc(r io.Reader) (map[string]Credential, error) {
+	credentials := make(map[string]Credential)
+
+	var host string
+	var cred Credential
+	var inEntry, inMacro bool
+	saveEntry := func() {
+		if inEntry {
+			if _, exist := credentials[host]; !exist {
+				credentials[host] = cred
+			}
+		}
+		inEntry = false
+		cred = Credential{}
+	}
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+
+		// Macro definition continues until an empty line
+		if inMacro {
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			if strings.HasPrefix(fields[i], "#") {
+				break
+			}
+
+			// Every keyword except "default" is followed by a value
+			keyword := fields[i]
+			if keyword == "default" {
+				saveEntry()
+				host, inEntry = "*", true
+				continue
+			}
+
+			if i+1 >= len(fields) {
+				return nil, fmt.Errorf("line %d: missing value for %q", lineNumber, keyword)
+			}
+			i++
+			value := fields[i]
+
+			switch keyword {
+			case "machine":
+				saveEntry()
+				host, inEntry = value, true
+			case "login":
+				cred.Username = value
+			case "password":
+				cred.Password = value
+			case "account":
+			case "macdef":
+				saveEntry()
+				inMacro = true
+			default:
+				return nil, fmt.Errorf("line %d: unknown keyword %q", lineNumber, keyword)
+			}
+
+			if inMacro {
+				break
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	saveEntry()
+	return credentials, nil
+}
+
+// LoadNetrcFile reads credentials from .netrc file in the path.
+func LoadNetrcFile(path string) (map[string]Credential, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	credentials, err := ParseNetrc(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return credentials, nil
+}
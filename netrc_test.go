@@ -0,0 +1,93 @@
+package obelisk
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseNetrc(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected map[string]Credential
+		hasError bool
+	}{{
+		name:  "one entry per line",
+		input: "machine example.com\nlogin user\npassword secret\n",
+		expected: map[string]Credential{
+			"example.com": {Username: "user", Password: "secret"},
+		},
+	}, {
+		name:  "several entries in one line",
+		input: "machine a.com login a password 1 machine b.com login b password 2",
+		expected: map[string]Credential{
+			"a.com": {Username: "a", Password: "1"},
+			"b.com": {Username: "b", Password: "2"},
+		},
+	}, {
+		name:  "default entry",
+		input: "machine a.com login a password 1\ndefault login anon password guest\n",
+		expected: map[string]Credential{
+			"a.com": {Username: "a", Password: "1"},
+			"*":     {Username: "anon", Password: "guest"},
+		},
+	}, {
+		name:  "first entry wins",
+		input: "machine a.com login first password 1\nmachine a.com login second password 2\n",
+		expected: map[string]Credential{
+			"a.com": {Username: "first", Password: "1"},
+		},
+	}, {
+		name:  "account is ignored",
+		input: "machine a.com login a account acc password 1",
+		expected: map[string]Credential{
+			"a.com": {Username: "a", Password: "1"},
+		},
+	}, {
+		name:  "comments",
+		input: "# my servers\nmachine a.com login a password 1 # the main one\n",
+		expected: map[string]Credential{
+			"a.com": {Username: "a", Password: "1"},
+		},
+	}, {
+		name:  "macro is skipped",
+		input: "machine a.com login a password 1\nmacdef init\nmachine fake.com login x\npassword y\n\nmachine b.com login b password 2\n",
+		expected: map[string]Credential{
+			"a.com": {Username: "a", Password: "1"},
+			"b.com": {Username: "b", Password: "2"},
+		},
+	}, {
+		name:     "empty",
+		input:    "",
+		expected: map[string]Credential{},
+	}, {
+		name:     "missing value",
+		input:    "machine a.com login",
+		hasError: true,
+	}, {
+		name:     "unknown keyword",
+		input:    "machine a.com user a",
+		hasError: true,
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			credentials, err := ParseNetrc(strings.NewReader(test.input))
+			if test.hasError {
+				if err == nil {
+					t.Fatalf("expected error, got %v", credentials)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if !reflect.DeepEqual(credentials, test.expected) {
+				t.Errorf("got %v, want %v", credentials, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package obelisk
+
+import "time"
+
+// Event is the information about a web page or a resource, passed to Observer.
+type Event struct {
+	URL       string
+	ParentURL string // empty for the web page itself
+	Bytes     int64
+	Duration  time.Duration
+	Err       error
+}
+
+// Observer receives events from the archival process, e.g. to draw progress
+// bar or collect metrics. Its methods might be called concurrently, so the
+// implementation must be safe for concurrent use. Embed NopObserver to only
+// implement the needed methods.
+type Observer interface {
+	// PageStarted is called when archival for a web page started.
+	PageStarted(e Event)
+
+	// PageFinished is called when archival for a web page finished. Bytes is
+	// size of the archive, and Err is set if the archival failed.
+	PageFinished(e Event)
+
+	// ResourceQueued is called when a resource found and waiting to be processed.
+	ResourceQueued(e Event)
+
+	// DownloadStarted is called when a resource starts being downloaded.
+	DownloadStarted(e Event)
+
+	// DownloadFinished is called when a resource successfully downloaded
+	// and processed. Bytes is size of the processed resource.
+	DownloadFinished(e Event)
+
+	// CacheHit is called when a resource is served from cache.
+	CacheHit(e Event)
+
+	// ResourceSkipped is called when a resource is not processed,
+	// so it's kept as remote URL.
+	ResourceSkipped(e Event)
+
+	// ResourceFailed is called when a resource failed to be downloaded or processed.
+	ResourceFailed(e Event)
+}
+
+// NopObserver is Observer that does nothing.
+type NopObserver struct{}
+
+func (NopObserver) PageStarted(Event)      {}
+func (NopObserver) PageFinished(Event)     {}
+func (NopObserver) ResourceQueued(Event)   {}
+func (NopObserver) DownloadStarted(Event)  {}
+func (NopObserver) DownloadFinished(Event) {}
+func (NopObserver) CacheHit(Event)         {}
+func (NopObserver) ResourceSkipped(Event)  {}
+func (NopObserver) ResourceFailed(Event)   {}
@@ -0,0 +1,344 @@
+package obelisk
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"time"
+)
+
+// Option is a function to configure Archiver. It's used by New to create
+// a new archiver, and by Request.Options to override the archiver's
+// configuration for a single request.
+type Option func(*Archiver)
+
+// New creates a new Archiver configured using the specified options.
+// The returned archiver is already validated and ready to use. It's safe
+// to use it for several requests at once, as long as its fields are not
+// modified. To use different configuration for a request, put the
+// options into Request.Options instead.
+func New(opts ...Option) *Archiver {
+	arc := &Archiver{}
+	for _, opt := range opts {
+		opt(arc)
+	}
+
+	arc.Validate()
+	return arc
+}
+
+// WithUserAgent sets user agent that used for every request.
+func WithUserAgent(userAgent string) Option {
+	return func(arc *Archiver) {
+		arc.UserAgent = userAgent
+	}
+}
+
+// WithCookieJar sets cookie jar that stores cookies for the requests.
+func WithCookieJar(jar http.CookieJar) Option {
+	return func(arc *Archiver) {
+		arc.CookieJar = jar
+	}
+}
+
+// WithCookies sets cookies that attached to every request, regardless of
+// its domain. Use WithCookieJar to only send cookies to the matching URLs.
+func WithCookies(cookies []*http.Cookie) Option {
+	return func(arc *Archiver) {
+		arc.cookies = cookies
+	}
+}
+
+// WithHeader adds a header that sent with every request.
+func WithHeader(key, value string) Option {
+	return func(arc *Archiver) {
+		// Clone the header, so archiver that shares it is not modified
+		arc.Header = arc.Header.Clone()
+		if arc.Header == nil {
+			arc.Header = http.Header{}
+		}
+		arc.Header.Add(key, value)
+	}
+}
+
+// WithHostHeader adds a header that only sent to the host and its subdomains.
+func WithHostHeader(host, key, value string) Option {
+	return func(arc *Archiver) {
+		// Clone the headers, so archiver that shares them is not modified
+		hostHeaders := make(map[string]http.Header, len(arc.HostHeaders)+1)
+		for h, header := range arc.HostHeaders {
+			hostHeaders[h] = header
+		}
+
+		header := hostHeaders[host].Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+
+		header.Add(key, value)
+		hostHeaders[host] = header
+		arc.HostHeaders = hostHeaders
+	}
+}
+
+// WithCredential sets username and password for authentication to the
+// host. Use "*" as host to use it for the host of archived page.
+func WithCredential(host, username, password string) Option {
+	return func(arc *Archiver) {
+		// Clone the credentials, so archiver that shares them is not modified
+		credentials := make(map[string]Credential, len(arc.Credentials)+1)
+		for h, cred := range arc.Credentials {
+			credentials[h] = cred
+		}
+
+		credentials[host] = Credential{Username: username, Password: password}
+		arc.Credentials = credentials
+	}
+}
+
+// WithDisableJS sets whether JavaScript should be removed from archive.
+func WithDisableJS(disable bool) Option {
+	return func(arc *Archiver) {
+		arc.DisableJS = disable
+	}
+}
+
+// WithDisableCSS sets whether CSS should be removed from archive.
+func WithDisableCSS(disable bool) Option {
+	return func(arc *Archiver) {
+		arc.DisableCSS = disable
+	}
+}
+
+// WithDisableEmbeds sets whether embedded elements (e.g. iframe) should
+// be removed from archive.
+func WithDisableEmbeds(disable bool) Option {
+	return func(arc *Archiver) {
+		arc.DisableEmbeds = disable
+	}
+}
+
+// WithDisableMedias sets whether media elements (e.g. img, audio) should
+// be removed from archive.
+func WithDisableMedias(disable bool) Option {
+	return func(arc *Archiver) {
+		arc.DisableMedias = disable
+	}
+}
+
+// WithFilterRules sets rules to decide which resources should be kept
+// as remote URL instead of embedded.
+func WithFilterRules(rules ...FilterRule) Option {
+	return func(arc *Archiver) {
+		arc.FilterRules = rules
+	}
+}
+
+// WithMaxResourceSize sets the maximum size of a single resource.
+func WithMaxResourceSize(size int64) Option {
+	return func(arc *Archiver) {
+		arc.MaxResourceSize = size
+	}
+}
+
+// WithMaxArchiveSize sets the maximum total size of resources embedded in an archive.
+func WithMaxArchiveSize(size int64) Option {
+	return func(arc *Archiver) {
+		arc.MaxArchiveSize = size
+	}
+}
+
+// WithRequestTimeout sets the maximum time for a single HTTP request.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(arc *Archiver) {
+		arc.RequestTimeout = timeout
+	}
+}
+
+// WithArchiveTimeout sets the maximum time for the entire archival,
+// including all of its resources.
+func WithArchiveTimeout(timeout time.Duration) Option {
+	return func(arc *Archiver) {
+		arc.ArchiveTimeout = timeout
+	}
+}
+
+// WithTransport sets the HTTP transport that used to download resources.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(arc *Archiver) {
+		arc.Transport = transport
+		arc.transport = nil
+	}
+}
+
+// WithProxies sets rules that decide the proxy for each request.
+func WithProxies(rules ...ProxyRule) Option {
+	return func(arc *Archiver) {
+		arc.Proxies = rules
+		arc.transport = nil
+	}
+}
+
+// WithInsecureSkipVerify sets whether server's TLS certificate should not be verified.
+func WithInsecureSkipVerify(skip bool) Option {
+	return func(arc *Archiver) {
+		arc.InsecureSkipVerify = skip
+		arc.transport = nil
+	}
+}
+
+// WithCache sets storage for the downloaded assets.
+func WithCache(cache AssetCache) Option {
+	return func(arc *Archiver) {
+		arc.Cache = cache
+	}
+}
+
+// WithMaxRetries sets the maximum number of retries for a single request.
+func WithMaxRetries(maxRetries int) Option {
+	return func(arc *Archiver) {
+		arc.MaxRetries = maxRetries
+	}
+}
+
+// WithRetryPolicy sets the policy that decides whether a failed request
+// should be retried. It overrides WithMaxRetries.
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(arc *Archiver) {
+		arc.RetryPolicy = policy
+	}
+}
+
+// WithMaxConcurrentDownload sets the maximum number of concurrent downloads.
+// It's ignored when used in Request.Options, since the limit is shared by
+// every request.
+func WithMaxConcurrentDownload(maxConcurrentDownload int64) Option {
+	return func(arc *Archiver) {
+		arc.MaxConcurrentDownload = maxConcurrentDownload
+	}
+}
+
+// WithMaxConcurrentPerHost sets the maximum number of concurrent downloads
+// from a single host. It's ignored when used in Request.Options, since the
+// limit is shared by every request.
+func WithMaxConcurrentPerHost(maxConcurrent int64) Option {
+	return func(arc *Archiver) {
+		arc.MaxConcurrentPerHost = maxConcurrent
+	}
+}
+
+// WithHostRateLimit sets the maximum number of requests per second sent to
+// a single host. It's ignored when used in Request.Options, since the limit
+// is shared by every request.
+func WithHostRateLimit(rate float64) Option {
+	return func(arc *Archiver) {
+		arc.HostRateLimit = rate
+	}
+}
+
+// WithSkipResourceURLError sets whether failed resource should be skipped
+// instead of failing the entire archival.
+func WithSkipResourceURLError(skip bool) Option {
+	return func(arc *Archiver) {
+		arc.SkipResourceURLError = skip
+	}
+}
+
+// WithWrapDirectory sets directory to store resources, instead of
+// embedding them into a single file.
+func WithWrapDirectory(dir string) Option {
+	return func(arc *Archiver) {
+		arc.WrapDirectory = dir
+	}
+}
+
+// WithLog enables logging for the archival process.
+func WithLog(enable bool, verbose bool) Option {
+	return func(arc *Archiver) {
+		arc.EnableLog = enable
+		arc.EnableVerboseLog = verbose
+	}
+}
+
+// WithLogger sets the logger for archival process.
+func WithLogger(logger Logger) Option {
+	return func(arc *Archiver) {
+		arc.Logger = logger
+	}
+}
+
+// WithObserver sets observer that receives events of the archival process.
+func WithObserver(observer Observer) Option {
+	return func(arc *Archiver) {
+		arc.Observer = observer
+	}
+}
+
+// WithRootCAs sets certificate authorities that used to verify server's
+// TLS certificate.
+func WithRootCAs(pool *x509.CertPool) Option {
+	return func(arc *Archiver) {
+		arc.RootCAs = pool
+		arc.transport = nil
+	}
+}
+
+// WithClientCertificates sets certificates that presented to server that
+// asks for client certificate.
+func WithClientCertificates(certs ...tls.Certificate) Option {
+	return func(arc *Archiver) {
+		arc.ClientCertificates = certs
+		arc.transport = nil
+	}
+}
+
+// WithResolveOverride connects to the address when "host:port" is requested.
+func WithResolveOverride(hostPort, address string) Option {
+	return func(arc *Archiver) {
+		// Clone the overrides, so archiver that shares them is not modified
+		overrides := make(map[string]string, len(arc.ResolveOverrides)+1)
+		for hp, addr := range arc.ResolveOverrides {
+			overrides[hp] = addr
+		}
+
+		overrides[hostPort] = address
+		arc.ResolveOverrides = overrides
+		arc.transport = nil
+	}
+}
+
+// withOptions returns a copy of archiver with the options applied. The copy
+// shares cache and download limit with the original archiver.
+func (arc *Archiver) withOptions(opts ...Option) *Archiver {
+	if len(opts) == 0 {
+		return arc
+	}
+
+	clone := *arc
+	for _, opt := range opts {
+		opt(&clone)
+	}
+
+	if clone.Cache == nil {
+		clone.Cache = arc.Cache
+	}
+
+	if clone.UserAgent == "" {
+		clone.UserAgent = defaultUserAgent
+	}
+
+	// Only rebuild the transport if its configuration changed, so the
+	// connections can be reused across requests
+	if clone.transport == nil {
+		clone.transport = clone.resolveTransport()
+	}
+
+	if clone.Observer == nil {
+		clone.Observer = NopObserver{}
+	}
+
+	clone.logger = clone.resolveLogger()
+	clone.retryPolicy = clone.resolveRetryPolicy()
+	clone.httpClient = clone.newHTTPClient()
+	return &clone
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"io"
 	nurl "net/url"
+	"slices"
 	"strings"
 	"sync"
 
@@ -13,69 +14,398 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-func (arc *Archiver) processCSS(ctx context.Context, input io.Reader, baseURL *nurl.URL) (string, error) {
-	// Prepare buffer to store content from input
-	buffer := bytes.NewBuffer(nil)
+type ctxKeyCSSImports struct{}
 
-	// Scan CSS and find all URLs
-	urls := make(map[string]struct{})
-	lexer := css.NewLexer(parse.NewInput(input))
+// withCSSImport adds the stylesheet into the chain of stylesheets that
+// currently importing, which used to prevent cyclic imports.
+func withCSSImport(ctx context.Context, url string) context.Context {
+	imports := cssImportsFromContext(ctx)
+	newImports := make([]string, len(imports), len(imports)+1)
+	copy(newImports, imports)
+	return context.WithValue(ctx, ctxKeyCSSImports{}, append(newImports, url))
+}
+
+func cssImportsFromContext(ctx context.Context) []string {
+	if imports, ok := ctx.Value(ctxKeyCSSImports{}).([]string); ok {
+		return imports
+	}
+	return nil
+}
+
+// cssToken is a token of stylesheet.
+type cssToken struct {
+	tt   css.TokenType
+	data []byte
+}
+
+// cssRef is an URL that referenced by a token in stylesheet.
+type cssRef struct {
+	url      string
+	kind     ResourceKind
+	isString bool // the URL is written as string, e.g. in image-set()
+}
 
+// cssImport is an @import rule, which will be replaced by the content of
+// the imported stylesheet.
+type cssImport struct {
+	url        string
+	end        int    // index of the last token in the rule
+	conditions string // everything after the URL, kept for unprocessed import
+	hasLayer   bool
+	layer      string
+	supports   string
+	media      string
+}
+
+// processCSS embeds the resources that used by the stylesheet. Relative URLs
+// are resolved against baseURL, while parentURL is the URL of document that
+// contains the stylesheet, which used as referrer of the resources.
+func (arc *Archiver) processCSS(ctx context.Context, input io.Reader, baseURL *nurl.URL, parentURL string) (string, error) {
+	// Read all tokens, so the URLs can be replaced in one pass
+	var tokens []cssToken
+	lexer := css.NewLexer(parse.NewInput(input))
 	for {
 		token, bt := lexer.Next()
-
-		// Check for error or EOF
 		if token == css.ErrorToken {
 			break
 		}
+		tokens = append(tokens, cssToken{tt: token, data: bt})
+	}
 
-		// If it's URL save it
-		if token == css.URLToken {
-			urls[string(bt)] = struct{}{}
-		}
+	// Scan CSS and find all URLs. URLs inside @font-face are fonts,
+	// while the others most likely are images. Strings are URLs as well
+	// when they are the direct arguments of image-set() or src().
+	refs := make(map[int]cssRef)
+	imports := make(map[int]*cssImport)
+	removed := make(map[int]int) // start index to end index of removed rule
+
+	depth := 0
+	fontFaceDepth := 0
+	inFontFaceRule := false
+	var functions []string
+
+	for i := 0; i < len(tokens); i++ {
+		token := tokens[i]
+		switch token.tt {
+		case css.AtKeywordToken:
+			atRule := strings.ToLower(string(token.data))
+			inFontFaceRule = atRule == "@font-face"
+
+			switch {
+			case atRule == "@charset":
+				// Stylesheet is always saved as UTF-8, so drop its @charset rule
+				removed[i] = cssRuleEnd(tokens, i)
+				i = removed[i]
+
+			case atRule == "@import" && depth == 0:
+				if imp := parseCSSImport(tokens, i); imp != nil {
+					imports[i] = imp
+					i = imp.end
+				}
+			}
+
+		case css.LeftBraceToken:
+			depth++
+			if inFontFaceRule {
+				fontFaceDepth = depth
+				inFontFaceRule = false
+			}
+
+		case css.RightBraceToken:
+			if depth == fontFaceDepth {
+				fontFaceDepth = 0
+			}
+			depth--
+
+		case css.FunctionToken:
+			functions = append(functions, strings.ToLower(string(token.data)))
+
+		case css.LeftParenthesisToken:
+			functions = append(functions, "(")
+
+		case css.RightParenthesisToken:
+			if len(functions) > 0 {
+				functions = functions[:len(functions)-1]
+			}
+
+		case css.URLToken, css.StringToken:
+			kind := KindImage
+			if fontFaceDepth > 0 {
+				kind = KindFont
+			}
+
+			if token.tt == css.URLToken {
+				refs[i] = cssRef{url: string(token.data), kind: kind}
+				continue
+			}
+
+			if len(functions) == 0 {
+				continue
+			}
 
-		buffer.Write(bt)
+			switch functions[len(functions)-1] {
+			case "image-set(", "-webkit-image-set(":
+				refs[i] = cssRef{url: string(token.data), kind: KindImage, isString: true}
+			case "src(":
+				refs[i] = cssRef{url: string(token.data), kind: kind, isString: true}
+			}
+		}
 	}
 
 	// Process each url concurrently
 	mutex := sync.RWMutex{}
 	processedURLs := make(map[string]string)
+	importedCSS := make(map[int]string)
 
 	g, ctx := errgroup.WithContext(ctx)
-	for url := range urls {
-		url := url
+	for _, i := range uniqueCSSRefs(refs) {
+		ref := refs[i]
 		g.Go(func() error {
-			cssURL := sanitizeStyleURL(url)
+			cssURL := sanitizeStyleURL(ref.url)
 			cssURL = createAbsoluteURL(cssURL, baseURL)
-			content, contentType, err := arc.processURL(ctx, cssURL, baseURL.String())
+			content, contentType, err := arc.processURL(ctx, cssURL, parentURL, ref.kind)
 			if err != nil && err != errSkippedURL {
 				return err
 			}
 
-			var result string
-			if err == errSkippedURL {
-				result = `url("` + cssURL + `")`
-			} else {
-				result = `url("` + arc.transform(cssURL, content, contentType) + `")`
+			// URL that doesn't refer to remote resource is kept as it
+			// is, e.g. data URL or fragment
+			result := cssURL
+			switch {
+			case err == nil:
+				result = arc.transform(ctx, cssURL, content, contentType)
+			case cssURL == "" || strings.HasPrefix(cssURL, "data:") || strings.HasPrefix(cssURL, "#"):
+				return nil
 			}
 
 			mutex.Lock()
-			processedURLs[url] = result
+			processedURLs[ref.url] = result
 			mutex.Unlock()
 
 			return nil
 		})
 	}
 
+	// Imported stylesheets are inlined, except the ones that imported by
+	// themselves or their descendants, which are dropped like browsers do.
+	importCtx := withCSSImport(ctx, parentURL)
+	ancestors := cssImportsFromContext(importCtx)
+	for start, imp := range imports {
+		start, imp := start, imp
+		imp.url = createAbsoluteURL(sanitizeStyleURL(imp.url), baseURL)
+		if slices.Contains(ancestors, imp.url) {
+			removed[start] = imp.end
+			continue
+		}
+
+		g.Go(func() error {
+			content, contentType, err := arc.processURL(importCtx, imp.url, parentURL, KindStylesheet)
+			if err != nil && err != errSkippedURL {
+				return err
+			}
+
+			if err == nil && mediaTypeOf(contentType) == "text/css" {
+				mutex.Lock()
+				importedCSS[start] = imp.inline(b2s(content))
+				mutex.Unlock()
+			}
+
+			return nil
+		})
+	}
+
 	if err := g.Wait(); err != nil {
-		return buffer.String(), err
+		return b2s(joinCSSTokens(tokens)), err
 	}
 
-	// Convert all url into the processed URL
-	cssRules := buffer.String()
-	for url, processedURL := range processedURLs {
-		cssRules = strings.ReplaceAll(cssRules, url, processedURL)
+	// Write the stylesheet with its URLs replaced by the processed ones
+	buffer := bytes.NewBuffer(nil)
+	for i := 0; i < len(tokens); i++ {
+		if end, isRemoved := removed[i]; isRemoved {
+			i = end
+			continue
+		}
+
+		if imp, isImport := imports[i]; isImport {
+			if content, ok := importedCSS[i]; ok {
+				buffer.WriteString(content)
+			} else {
+				buffer.WriteString(`@import url("` + escapeCSSString(imp.url) + `")` + imp.conditions + ";")
+			}
+			i = imp.end
+			continue
+		}
+
+		ref, isRef := refs[i]
+		processedURL, isProcessed := processedURLs[ref.url]
+		switch {
+		case !isRef || !isProcessed:
+			buffer.Write(tokens[i].data)
+		case ref.isString:
+			buffer.WriteString(`"` + escapeCSSString(processedURL) + `"`)
+		default:
+			buffer.WriteString(`url("` + escapeCSSString(processedURL) + `")`)
+		}
+	}
+
+	return buffer.String(), nil
+}
+
+// uniqueCSSRefs returns index of the first token for each distinct URL.
+func uniqueCSSRefs(refs map[int]cssRef) []int {
+	firstIndex := make(map[string]int)
+	for i, ref := range refs {
+		if first, exist := firstIndex[ref.url]; !exist || i < first {
+			firstIndex[ref.url] = i
+		}
+	}
+
+	indexes := make([]int, 0, len(firstIndex))
+	for _, i := range firstIndex {
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
+
+// parseCSSImport parses the @import rule that starts at the index. Returns
+// nil if it's not a valid rule.
+func parseCSSImport(tokens []cssToken, start int) *cssImport {
+	imp := &cssImport{end: cssRuleEnd(tokens, start)}
+
+	// The first token after at-keyword is the URL
+	i := start + 1
+	for i <= imp.end && isCSSSpace(tokens[i].tt) {
+		i++
+	}
+
+	if i > imp.end {
+		return nil
+	}
+
+	switch tokens[i].tt {
+	case css.URLToken, css.StringToken:
+		imp.url = string(tokens[i].data)
+	default:
+		return nil
+	}
+
+	// The rest are optional layer, supports condition and media queries
+	var conditions, media bytes.Buffer
+	for i++; i <= imp.end && tokens[i].tt != css.SemicolonToken; i++ {
+		token := tokens[i]
+		name := strings.ToLower(string(token.data))
+		inMedia := media.Len() > 0
+
+		switch {
+		case !inMedia && token.tt == css.IdentToken && name == "layer":
+			imp.hasLayer = true
+			conditions.Write(token.data)
+
+		case !inMedia && token.tt == css.FunctionToken && (name == "layer(" || name == "supports("):
+			end := min(cssBlockEnd(tokens, i), imp.end)
+			args := strings.TrimSpace(b2s(joinCSSTokens(tokens[i+1 : end])))
+			conditions.Write(joinCSSTokens(tokens[i : end+1]))
+
+			if name == "layer(" {
+				imp.hasLayer = true
+				imp.layer = args
+			} else {
+				imp.supports = args
+			}
+			i = end
+
+		case !inMedia && isCSSSpace(token.tt):
+			conditions.Write(token.data)
+
+		default:
+			conditions.Write(token.data)
+			media.Write(token.data)
+		}
 	}
 
-	return cssRules, nil
+	imp.conditions = strings.TrimRight(conditions.String(), " \t\r\n\f")
+	imp.media = strings.TrimSpace(media.String())
+	return imp
+}
+
+// inline wraps the imported stylesheet, so its rules only applied following
+// the conditions of @import rule.
+func (imp *cssImport) inline(content string) string {
+	var before, after string
+	if imp.media != "" && !strings.EqualFold(imp.media, "all") {
+		before = "@media " + imp.media + " {\n"
+		after = "\n}"
+	}
+
+	if imp.supports != "" {
+		supports := imp.supports
+		if !strings.HasPrefix(supports, "(") {
+			supports = "(" + supports + ")"
+		}
+		before = "@supports " + supports + " {\n" + before
+		after += "\n}"
+	}
+
+	if imp.hasLayer {
+		layer := "@layer "
+		if imp.layer != "" {
+			layer += imp.layer + " "
+		}
+		before = layer + "{\n" + before
+		after += "\n}"
+	}
+
+	return before + content + after
+}
+
+// cssRuleEnd returns the index of semicolon that ends the at-rule, or the
+// last token if there are none.
+func cssRuleEnd(tokens []cssToken, start int) int {
+	for i := start + 1; i < len(tokens); i++ {
+		switch tokens[i].tt {
+		case css.SemicolonToken:
+			return i
+		case css.FunctionToken, css.LeftParenthesisToken:
+			i = cssBlockEnd(tokens, i)
+		}
+	}
+	return len(tokens) - 1
+}
+
+// cssBlockEnd returns the index of parenthesis that closes the function or
+// parenthesis at the index, or the last token if it's never closed.
+func cssBlockEnd(tokens []cssToken, start int) int {
+	depth := 0
+	for i := start; i < len(tokens); i++ {
+		switch tokens[i].tt {
+		case css.FunctionToken, css.LeftParenthesisToken:
+			depth++
+		case css.RightParenthesisToken:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(tokens) - 1
+}
+
+var cssStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\a `, "\r", `\d `)
+
+// escapeCSSString escapes the value so it can be written as double quoted
+// string in stylesheet.
+func escapeCSSString(value string) string {
+	return cssStringEscaper.Replace(value)
+}
+
+func isCSSSpace(tt css.TokenType) bool {
+	return tt == css.WhitespaceToken || tt == css.CommentToken
+}
+
+func joinCSSTokens(tokens []cssToken) []byte {
+	var buffer bytes.Buffer
+	for _, token := range tokens {
+		buffer.Write(token.data)
+	}
+	return buffer.Bytes()
 }
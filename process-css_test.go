@@ -0,0 +1,186 @@
+package obelisk
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	nurl "net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestProcessCSS(t *testing.T) {
+	files := map[string]string{
+		"/a.png":       "A",
+		"/b.png":       "B",
+		"/font.woff":   "F",
+		"/plain.css":   "p{color:red}",
+		"/cycle-a.css": `@import "cycle-b.css";a{color:red}`,
+		"/cycle-b.css": `@import "cycle-a.css";b{color:blue}`,
+		"/self.css":    `@import "self.css";s{color:green}`,
+		"/nested.css":  `@charset "utf-8";@import "plain.css" print;n{background:url(a.png)}`,
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, exist := files[r.URL.Path]
+		if !exist {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, ".css"):
+			w.Header().Set("Content-Type", "text/css")
+		case strings.HasSuffix(r.URL.Path, ".woff"):
+			w.Header().Set("Content-Type", "font/woff")
+		default:
+			w.Header().Set("Content-Type", "image/png")
+		}
+		w.Write([]byte(content))
+	}))
+	defer srv.Close()
+
+	pngA := "data:image/png;base64,QQ=="
+	pngB := "data:image/png;base64,Qg=="
+	woff := "data:font/woff;base64,Rg=="
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{{
+		name:     "url",
+		input:    `a{background:url(a.png)}`,
+		expected: `a{background:url("` + pngA + `")}`,
+	}, {
+		name:     "quoted url",
+		input:    `a{background:url('a.png')}`,
+		expected: `a{background:url("` + pngA + `")}`,
+	}, {
+		name:     "same url used twice",
+		input:    `a{background:url(a.png)}b{background:url(a.png)}`,
+		expected: `a{background:url("` + pngA + `")}b{background:url("` + pngA + `")}`,
+	}, {
+		name:     "strings in image-set",
+		input:    `a{background:image-set('a.png' 1x, "b.png" 2x)}`,
+		expected: `a{background:image-set("` + pngA + `" 1x, "` + pngB + `" 2x)}`,
+	}, {
+		name:     "strings in prefixed image-set",
+		input:    `a{background:-webkit-image-set("a.png" 1x)}`,
+		expected: `a{background:-webkit-image-set("` + pngA + `" 1x)}`,
+	}, {
+		name:     "url in image-set",
+		input:    `a{background:image-set(url(a.png) 1x)}`,
+		expected: `a{background:image-set(url("` + pngA + `") 1x)}`,
+	}, {
+		name:     "data url",
+		input:    `a{background:url('data:image/svg+xml;utf8,<svg xmlns="http://www.w3.org/2000/svg"></svg>')}`,
+		expected: `a{background:url('data:image/svg+xml;utf8,<svg xmlns="http://www.w3.org/2000/svg"></svg>')}`,
+	}, {
+		name:     "data url in image-set",
+		input:    `a{background:image-set('data:image/png;base64,QQ==' 1x)}`,
+		expected: `a{background:image-set('data:image/png;base64,QQ==' 1x)}`,
+	}, {
+		name:     "fragment",
+		input:    `a{filter:url(#blur);mask:url("#m")}`,
+		expected: `a{filter:url(#blur);mask:url("#m")}`,
+	}, {
+		name:     "skipped resource",
+		input:    `a{background:url(skipped.png)}`,
+		expected: `a{background:url("` + srv.URL + `/skipped.png")}`,
+	}, {
+		name:     "skipped resource in image-set",
+		input:    `a{background:image-set('skipped.png' 1x)}`,
+		expected: `a{background:image-set("` + srv.URL + `/skipped.png" 1x)}`,
+	}, {
+		name:     "strings outside image-set",
+		input:    `a::before{content:"a.png";font-family:'b.png'}`,
+		expected: `a::before{content:"a.png";font-family:'b.png'}`,
+	}, {
+		name:     "strings in other function",
+		input:    `a{background:image-set(attr("a.png") 1x)}`,
+		expected: `a{background:image-set(attr("a.png") 1x)}`,
+	}, {
+		name:     "font face",
+		input:    `@font-face{font-family:x;src:url(font.woff) format("woff")}`,
+		expected: `@font-face{font-family:x;src:url("` + woff + `") format("woff")}`,
+	}, {
+		name:     "charset removed",
+		input:    `@charset "utf-8";a{color:red}`,
+		expected: `a{color:red}`,
+	}, {
+		name:     "import",
+		input:    `@import url(plain.css);a{color:red}`,
+		expected: `p{color:red}a{color:red}`,
+	}, {
+		name:     "import with media",
+		input:    `@import "plain.css" screen;`,
+		expected: "@media screen {\np{color:red}\n}",
+	}, {
+		name:     "import with media all",
+		input:    `@import "plain.css" all;`,
+		expected: `p{color:red}`,
+	}, {
+		name:     "import with layer and supports",
+		input:    `@import "plain.css" layer(base) supports(display:grid) print;`,
+		expected: "@layer base {\n@supports (display:grid) {\n@media print {\np{color:red}\n}\n}\n}",
+	}, {
+		name:     "import with anonymous layer",
+		input:    `@import "plain.css" layer;`,
+		expected: "@layer {\np{color:red}\n}",
+	}, {
+		name:     "nested import",
+		input:    `@import "nested.css";`,
+		expected: "@media print {\np{color:red}\n}n{background:url(\"" + pngA + "\")}",
+	}, {
+		name:     "cyclic import",
+		input:    `@import "cycle-a.css";`,
+		expected: `b{color:blue}a{color:red}`,
+	}, {
+		name:     "self import",
+		input:    `@import "self.css";`,
+		expected: `s{color:green}`,
+	}, {
+		name:     "import inside block",
+		input:    `@media print{@import "plain.css";}`,
+		expected: `@media print{@import "plain.css";}`,
+	}}
+
+	arc := New(WithFilterRules(FilterRule{
+		Action:     FilterSkip,
+		URLPattern: regexp.MustCompile(`skipped`),
+	}))
+	baseURL, _ := nurl.Parse(srv.URL + "/page.html")
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := arc.processCSS(context.Background(), strings.NewReader(test.input), baseURL, baseURL.String())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if result != test.expected {
+				t.Errorf("unexpected result\n got: %q\nwant: %q", result, test.expected)
+			}
+		})
+	}
+}
+
+func TestEscapeCSSString(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`http://example.com/a.png`, `http://example.com/a.png`},
+		{`a"b`, `a\"b`},
+		{`a\b`, `a\\b`},
+		{"a\nb", `a\a b`},
+	}
+
+	for _, test := range tests {
+		if result := escapeCSSString(test.input); result != test.expected {
+			t.Errorf("escapeCSSString(%q) = %q, want %q", test.input, result, test.expected)
+		}
+	}
+}
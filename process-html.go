@@ -35,8 +35,27 @@ func originFromContext(ctx context.Context) *nurl.URL {
 	return nil
 }
 
+func (arc *Archiver) processHTML(ctx context.Context, input io.Reader, baseURL *nurl.URL, parentURL string, isFragment bool) (string, error) {
+	doc, err := arc.processHTMLDocument(ctx, input, baseURL, parentURL, isFragment)
+	if err != nil {
+		return "", err
+	}
+
+	// Convert document back to string
+	if isFragment {
+		return dom.InnerHTML(doc), nil
+	} else {
+		return dom.OuterHTML(doc), nil
+	}
+}
+
+// processHTMLDocument parses the HTML and embeds its resources. Relative URLs
+// are resolved against baseURL, unless the document has its own base element.
+// The resources are fetched with parentURL as their referrer, which is the
+// URL of the document itself.
+//
 //nolint:gocyclo,goconst
-func (arc *Archiver) processHTML(ctx context.Context, input io.Reader, baseURL *nurl.URL, isFragment bool) (string, error) {
+func (arc *Archiver) processHTMLDocument(ctx context.Context, input io.Reader, baseURL *nurl.URL, parentURL string, isFragment bool) (*html.Node, error) {
 	// Parse input into HTML document
 	var doc *html.Node
 	var err error
@@ -55,13 +74,14 @@ func (arc *Archiver) processHTML(ctx context.Context, input io.Reader, baseURL *
 		}
 	}
 	if err != nil {
-		return "", fmt.Errorf("failed to parse HTML: %w", err)
+		return nil, fmt.Errorf("failed to parse HTML: %w", err)
 	}
 
 	if !isFragment {
 		// Prepare documents by doing these steps :
 		// - Set Content-Security-Policy to make sure no unwanted Request happened
 		// - append source URL into head
+		// - Resolve base URL of document then remove its base elements
 		// - Add charset meta into head
 		// - Apply configuration to documents
 		// - Replace all noscript to divs, to make it processed as well
@@ -71,6 +91,7 @@ func (arc *Archiver) processHTML(ctx context.Context, input io.Reader, baseURL *
 		// - Remove subresources integrity attribute from links
 		arc.setContentSecurityPolicy(doc)
 		arc.setSourceURL(ctx, doc, baseURL)
+		baseURL = arc.resolveBaseURL(doc, baseURL)
 		arc.addMeta(doc)
 		arc.applyConfiguration(doc)
 		arc.convertNoScriptToDiv(doc, true)
@@ -84,8 +105,8 @@ func (arc *Archiver) processHTML(ctx context.Context, input io.Reader, baseURL *
 	// Find all nodes which might has subresource.
 	// A node might has subresource if it fulfills one of these criteria :
 	// - It has inline style;
-	// - It's link for icon or stylesheets;
-	// - It's tag name is either style, img, picture, figure, video, audio, source, iframe or object;
+	// - It's either style, script or SVG use;
+	// - It has attribute that refers to resource which can be embedded.
 	resourceNodes := make(map[*html.Node]struct{})
 	for _, node := range dom.GetElementsByTagName(doc, "*") {
 		if style := dom.GetAttribute(node, "style"); strings.TrimSpace(style) != "" {
@@ -94,26 +115,29 @@ func (arc *Archiver) processHTML(ctx context.Context, input io.Reader, baseURL *
 		}
 
 		switch dom.TagName(node) {
-		case "link":
-			rel := dom.GetAttribute(node, "rel")
-			if strings.Contains(rel, "icon") || strings.Contains(rel, "stylesheet") {
+		case "style", "script", "use":
+			resourceNodes[node] = struct{}{}
+			continue
+		}
+
+		for _, entry := range resourceAttrsOf(node) {
+			if !entry.linkOnly {
 				resourceNodes[node] = struct{}{}
+				break
 			}
-
-		case "iframe", "embed", "object", "style", "script",
-			"img", "picture", "figure", "video", "audio", "source":
-			resourceNodes[node] = struct{}{}
 		}
 	}
 
-	// Process each node concurrently
+	// Process each node concurrently. Symbols from external SVG sprites
+	// are collected, then inlined once all nodes processed.
+	sprites := newSVGSprites()
 	g, ctx := errgroup.WithContext(ctx)
 	for node := range resourceNodes {
 		node := node
 		g.Go(func() error {
 			// Update style attribute
 			if dom.HasAttribute(node, "style") {
-				err := arc.processStyleAttr(ctx, node, baseURL)
+				err := arc.processStyleAttr(ctx, node, baseURL, parentURL)
 				if err != nil {
 					return err
 				}
@@ -122,37 +146,49 @@ func (arc *Archiver) processHTML(ctx context.Context, input io.Reader, baseURL *
 			// Update node depending on its tag name
 			switch dom.TagName(node) {
 			case "style":
-				return arc.processStyleNode(ctx, node, baseURL)
-			case "link":
-				return arc.processLinkNode(ctx, node, baseURL)
+				return arc.processStyleNode(ctx, node, baseURL, parentURL)
 			case "script":
-				return arc.processScriptNode(ctx, node, baseURL)
-			case "object", "embed", "iframe":
-				return arc.processEmbedNode(ctx, node, baseURL)
-			case "img", "picture", "figure", "video", "audio", "source":
-				return arc.processMediaNode(ctx, node, baseURL)
+				return arc.processScriptNode(ctx, node, baseURL, parentURL)
 			case "template":
-				return arc.processTemplateNode(ctx, node, baseURL)
-			default:
-				return nil
+				return arc.processTemplateNode(ctx, node, baseURL, parentURL)
+			case "use":
+				if isSVGElement(node) {
+					return arc.processSVGUseNode(ctx, node, parentURL, sprites)
+				}
+			}
+
+			// Update attributes that refer to resources
+			for _, entry := range resourceAttrsOf(node) {
+				var err error
+				switch {
+				case entry.linkOnly:
+				case entry.tag == "link":
+					err = arc.processLinkNode(ctx, node, parentURL)
+				case entry.isSrcset:
+					err = arc.processSrcsetAttr(ctx, node, entry.attr, parentURL)
+				default:
+					err = arc.processURLNode(ctx, node, entry.attr, parentURL)
+				}
+
+				if err != nil {
+					return err
+				}
 			}
+
+			return nil
 		})
 	}
 
 	// Wait until all resources processed
 	if err = g.Wait(); err != nil {
-		return "", err
+		return nil, err
 	}
 
+	sprites.insert(doc)
+
 	// Revert the converted noscripts
 	arc.revertConvertedNoScript(doc)
-
-	// Convert document back to string
-	if isFragment {
-		return dom.InnerHTML(doc), nil
-	} else {
-		return dom.OuterHTML(doc), nil
-	}
+	return doc, nil
 }
 
 // setContentSecurityPolicy prevent browsers from Requesting any remote
@@ -224,12 +260,41 @@ func (arc *Archiver) setSourceURL(ctx context.Context, doc *html.Node, baseURL *
 	}
 }
 
+// resolveBaseURL returns the URL that used to resolve relative URLs in the
+// document, which decided by its first base element. Since the URLs will be
+// absolute, the base elements are removed so links in archive don't point to
+// other site. Base element with target is kept, but without its URL.
+func (arc *Archiver) resolveBaseURL(doc *html.Node, docURL *nurl.URL) *nurl.URL {
+	baseURL := docURL
+	foundBase := false
+	for _, base := range dom.GetElementsByTagName(doc, "base") {
+		if !foundBase && dom.HasAttribute(base, "href") {
+			foundBase = true
+			href := strings.TrimSpace(dom.GetAttribute(base, "href"))
+			if newURL, err := docURL.Parse(href); err == nil && (newURL.Scheme == "http" || newURL.Scheme == "https") {
+				baseURL = newURL
+			}
+		}
+
+		if dom.HasAttribute(base, "target") {
+			dom.RemoveAttribute(base, "href")
+		} else if base.Parent != nil {
+			base.Parent.RemoveChild(base)
+		}
+	}
+
+	return baseURL
+}
+
 // add head meta
 func (arc *Archiver) addMeta(doc *html.Node) {
+	// Document is always saved as UTF-8, so remove the old charset declarations
 	for _, meta := range dom.GetElementsByTagName(doc, "meta") {
-		charset := dom.GetAttribute(meta, "charset")
-		if charset != "" {
-			return
+		httpEquiv := dom.GetAttribute(meta, "http-equiv")
+		if dom.HasAttribute(meta, "charset") || strings.EqualFold(httpEquiv, "content-type") {
+			if meta.Parent != nil {
+				meta.Parent.RemoveChild(meta)
+			}
 		}
 	}
 
@@ -281,6 +346,19 @@ func (arc *Archiver) applyConfiguration(doc *html.Node) {
 		medias := dom.GetAllNodesWithTag(doc, "img", "picture", "figure", "video", "audio", "source")
 		dom.RemoveNodes(medias, nil)
 	}
+
+	// The other elements might refer to the disabled resources as well,
+	// e.g. icon link or table background. Their element is still needed,
+	// so only the attribute is removed.
+	if arc.DisableEmbeds || arc.DisableMedias {
+		for _, node := range dom.GetElementsByTagName(doc, "*") {
+			for _, entry := range resourceAttrsOf(node) {
+				if (entry.isMedia && arc.DisableMedias) || (entry.isEmbed && arc.DisableEmbeds) {
+					dom.RemoveAttribute(node, entry.attr)
+				}
+			}
+		}
+	}
 }
 
 // convertNoScriptToDiv convert all noscript to div element.
@@ -403,50 +481,25 @@ func (arc *Archiver) convertLazyImageAttrs(doc *html.Node) {
 }
 
 // convertRelativeURLs converts all relative URL in document into absolute URL.
-// We do this for a, img, picture, figure, video, audio, source, link,
-// embed, iframe and object.
+// We do this for every attribute listed in resourceAttrs.
 func (arc *Archiver) convertRelativeURLs(doc *html.Node, baseURL *nurl.URL) {
-	// Prepare nodes and methods
-	as := dom.GetElementsByTagName(doc, "a")
-	links := dom.GetElementsByTagName(doc, "link")
-	embeds := dom.GetElementsByTagName(doc, "embed")
-	scripts := dom.GetElementsByTagName(doc, "script")
-	iframes := dom.GetElementsByTagName(doc, "iframe")
-	objects := dom.GetElementsByTagName(doc, "object")
-	medias := dom.GetAllNodesWithTag(doc, "img", "picture", "figure", "video", "audio", "source")
-
-	convertNode := func(node *html.Node, attrName string) {
-		if dom.HasAttribute(node, attrName) {
-			val := dom.GetAttribute(node, attrName)
-			newVal := createAbsoluteURL(val, baseURL)
-			dom.SetAttribute(node, attrName, newVal)
-		}
-	}
-
-	convertNodes := func(nodes []*html.Node, attrName string) {
-		for _, node := range nodes {
-			convertNode(node, attrName)
-		}
-	}
-
-	// Convert all relative URLs
-	convertNodes(as, "href")
-	convertNodes(links, "href")
-	convertNodes(embeds, "src")
-	convertNodes(scripts, "src")
-	convertNodes(iframes, "src")
-	convertNodes(objects, "data")
-
-	for _, media := range medias {
-		convertNode(media, "src")
-		convertNode(media, "poster")
+	for _, node := range dom.GetElementsByTagName(doc, "*") {
+		for _, entry := range resourceAttrsOf(node) {
+			val := dom.GetAttribute(node, entry.attr)
+			if !entry.isSrcset {
+				newVal := createAbsoluteURL(val, baseURL)
+				if u, err := nurl.Parse(val); err == nil && entry.keepFragment && u.Fragment != "" && newVal != val {
+					newVal += "#" + u.EscapedFragment()
+				}
+				dom.SetAttribute(node, entry.attr, newVal)
+				continue
+			}
 
-		if srcset := dom.GetAttribute(media, "srcset"); srcset != "" {
-			newSrcset := rxSrcsetURL.ReplaceAllStringFunc(srcset, func(s string) string {
+			newSrcset := rxSrcsetURL.ReplaceAllStringFunc(val, func(s string) string {
 				p := rxSrcsetURL.FindStringSubmatch(s)
 				return createAbsoluteURL(p[1], baseURL) + p[2] + p[3]
 			})
-			dom.SetAttribute(media, "srcset", newSrcset)
+			dom.SetAttribute(node, entry.attr, newSrcset)
 		}
 	}
 }
@@ -508,29 +561,29 @@ func (arc *Archiver) removeComments(doc *html.Node) {
 	dom.RemoveNodes(comments, nil)
 }
 
-func (arc *Archiver) processURLNode(ctx context.Context, node *html.Node, attrName string, baseURL *nurl.URL) error {
+func (arc *Archiver) processURLNode(ctx context.Context, node *html.Node, attrName string, parentURL string) error {
 	if !dom.HasAttribute(node, attrName) {
 		return nil
 	}
 
 	url := dom.GetAttribute(node, attrName)
-	content, contentType, err := arc.processURL(ctx, url, baseURL.String())
+	content, contentType, err := arc.processURL(ctx, url, parentURL, resourceKindFromNode(node, attrName))
 	if err != nil && err != errSkippedURL {
 		return err
 	}
 
 	newURL := url
 	if err == nil {
-		newURL = arc.transform(url, content, contentType)
+		newURL = arc.transform(ctx, url, content, contentType)
 	}
 
 	dom.SetAttribute(node, attrName, newURL)
 	return nil
 }
 
-func (arc *Archiver) processStyleAttr(ctx context.Context, node *html.Node, baseURL *nurl.URL) error {
+func (arc *Archiver) processStyleAttr(ctx context.Context, node *html.Node, baseURL *nurl.URL, parentURL string) error {
 	style := dom.GetAttribute(node, "style")
-	newStyle, err := arc.processCSS(ctx, strings.NewReader(style), baseURL)
+	newStyle, err := arc.processCSS(ctx, strings.NewReader(style), baseURL, parentURL)
 	if err == nil {
 		dom.SetAttribute(node, "style", newStyle)
 	}
@@ -538,9 +591,9 @@ func (arc *Archiver) processStyleAttr(ctx context.Context, node *html.Node, base
 	return err
 }
 
-func (arc *Archiver) processStyleNode(ctx context.Context, node *html.Node, baseURL *nurl.URL) error {
+func (arc *Archiver) processStyleNode(ctx context.Context, node *html.Node, baseURL *nurl.URL, parentURL string) error {
 	style := dom.TextContent(node)
-	newStyle, err := arc.processCSS(ctx, strings.NewReader(style), baseURL)
+	newStyle, err := arc.processCSS(ctx, strings.NewReader(style), baseURL, parentURL)
 	if err == nil {
 		dom.SetTextContent(node, newStyle)
 	}
@@ -548,17 +601,18 @@ func (arc *Archiver) processStyleNode(ctx context.Context, node *html.Node, base
 	return err
 }
 
-func (arc *Archiver) processLinkNode(ctx context.Context, node *html.Node, baseURL *nurl.URL) error {
+func (arc *Archiver) processLinkNode(ctx context.Context, node *html.Node, parentURL string) error {
 	if !dom.HasAttribute(node, "href") {
 		return nil
 	}
 
-	if rel := dom.GetAttribute(node, "rel"); strings.Contains(rel, "icon") {
-		return arc.processURLNode(ctx, node, "href", baseURL)
+	// Only stylesheet is converted into style, the others are embedded as URL
+	if !hasLinkRel("stylesheet")(node) {
+		return arc.processURLNode(ctx, node, "href", parentURL)
 	}
 
 	url := dom.GetAttribute(node, "href")
-	content, contentType, err := arc.processURL(ctx, url, baseURL.String())
+	content, contentType, err := arc.processURL(ctx, url, parentURL, KindStylesheet)
 	if err != nil {
 		if err == errSkippedURL {
 			return nil
@@ -567,7 +621,7 @@ func (arc *Archiver) processLinkNode(ctx context.Context, node *html.Node, baseU
 	}
 
 	if arc.WrapDirectory != "" {
-		newSrc := arc.transform(url, content, contentType)
+		newSrc := arc.transform(ctx, url, content, contentType)
 		dom.SetAttribute(node, "href", newSrc)
 	} else {
 		// Remove all attributes for this node
@@ -583,8 +637,8 @@ func (arc *Archiver) processLinkNode(ctx context.Context, node *html.Node, baseU
 	return nil
 }
 
-func (arc *Archiver) processTemplateNode(ctx context.Context, node *html.Node, baseURL *nurl.URL) error {
-	result, err := arc.processHTML(ctx, strings.NewReader(dom.TextContent(node)), baseURL, true)
+func (arc *Archiver) processTemplateNode(ctx context.Context, node *html.Node, baseURL *nurl.URL, parentURL string) error {
+	result, err := arc.processHTML(ctx, strings.NewReader(dom.TextContent(node)), baseURL, parentURL, true)
 	if err != nil {
 		return err
 	}
@@ -592,9 +646,9 @@ func (arc *Archiver) processTemplateNode(ctx context.Context, node *html.Node, b
 	return nil
 }
 
-func (arc *Archiver) processScriptNode(ctx context.Context, node *html.Node, baseURL *nurl.URL) error {
+func (arc *Archiver) processScriptNode(ctx context.Context, node *html.Node, baseURL *nurl.URL, parentURL string) error {
 	if dom.GetAttribute(node, "type") == "text/template" {
-		if err := arc.processTemplateNode(ctx, node, baseURL); err != nil {
+		if err := arc.processTemplateNode(ctx, node, baseURL, parentURL); err != nil {
 			return err
 		}
 	}
@@ -603,7 +657,7 @@ func (arc *Archiver) processScriptNode(ctx context.Context, node *html.Node, bas
 	}
 
 	url := dom.GetAttribute(node, "src")
-	content, contentType, err := arc.processURL(ctx, url, baseURL.String())
+	content, contentType, err := arc.processURL(ctx, url, parentURL, KindScript)
 	if err != nil {
 		if err == errSkippedURL {
 			return nil
@@ -612,7 +666,7 @@ func (arc *Archiver) processScriptNode(ctx context.Context, node *html.Node, bas
 	}
 
 	if arc.WrapDirectory != "" {
-		newSrc := arc.transform(url, content, contentType)
+		newSrc := arc.transform(ctx, url, content, contentType)
 		dom.SetAttribute(node, "src", newSrc)
 	} else {
 		dom.RemoveAttribute(node, "src")
@@ -621,60 +675,25 @@ func (arc *Archiver) processScriptNode(ctx context.Context, node *html.Node, bas
 	return nil
 }
 
-func (arc *Archiver) processEmbedNode(ctx context.Context, node *html.Node, baseURL *nurl.URL) error {
-	attrName := "src"
-	if dom.TagName(node) == "object" {
-		attrName = "data"
-	}
-
+func (arc *Archiver) processSrcsetAttr(ctx context.Context, node *html.Node, attrName string, parentURL string) error {
 	if !dom.HasAttribute(node, attrName) {
 		return nil
 	}
 
-	url := dom.GetAttribute(node, attrName)
-	content, contentType, err := arc.processURL(ctx, url, baseURL.String())
-	if err != nil && err != errSkippedURL {
-		return err
-	}
-
-	newURL := url
-	if err == nil {
-		newURL = arc.transform(url, content, contentType)
-	}
-
-	dom.SetAttribute(node, attrName, newURL)
-	return nil
-}
-
-func (arc *Archiver) processMediaNode(ctx context.Context, node *html.Node, baseURL *nurl.URL) error {
-	err := arc.processURLNode(ctx, node, "src", baseURL)
-	if err != nil {
-		return err
-	}
-
-	err = arc.processURLNode(ctx, node, "poster", baseURL)
-	if err != nil {
-		return err
-	}
-
-	if !dom.HasAttribute(node, "srcset") {
-		return nil
-	}
-
 	var newSets []string
-	srcset := dom.GetAttribute(node, "srcset")
+	srcset := dom.GetAttribute(node, attrName)
 	for _, parts := range rxSrcsetURL.FindAllStringSubmatch(srcset, -1) {
 		oldURL := parts[1]
 		targetWidth := parts[2]
 
-		content, contentType, err := arc.processURL(ctx, oldURL, baseURL.String())
+		content, contentType, err := arc.processURL(ctx, oldURL, parentURL, resourceKindFromNode(node, attrName))
 		if err != nil && err != errSkippedURL {
 			return err
 		}
 
 		newSet := oldURL
 		if err == nil {
-			newSet = arc.transform(oldURL, content, contentType)
+			newSet = arc.transform(ctx, oldURL, content, contentType)
 		}
 
 		newSet += targetWidth
@@ -682,7 +701,7 @@ func (arc *Archiver) processMediaNode(ctx context.Context, node *html.Node, base
 	}
 
 	newSrcset := strings.Join(newSets, ",")
-	dom.SetAttribute(node, "srcset", newSrcset)
+	dom.SetAttribute(node, attrName, newSrcset)
 	return nil
 }
 
@@ -0,0 +1,267 @@
+package obelisk
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	nurl "net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-shiori/dom"
+	"golang.org/x/net/html"
+)
+
+// rxSVGURLRef matches reference to element by its ID, e.g. in fill="url(#g)".
+var rxSVGURLRef = regexp.MustCompile(`url\(\s*['"]?#([^'")\s]+)['"]?\s*\)`)
+
+type ctxKeySVGSprite struct{}
+
+// withSVGSprite marks that the document being processed is a SVG sprite, so
+// its own external sprites are not followed.
+func withSVGSprite(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeySVGSprite{}, true)
+}
+
+func isSVGSpriteContext(ctx context.Context) bool {
+	isSprite, _ := ctx.Value(ctxKeySVGSprite{}).(bool)
+	return isSprite
+}
+
+// svgSprites keeps the external SVG sprites that used by a document, and the
+// symbols from them that will be inlined into the document.
+type svgSprites struct {
+	mutex   sync.Mutex
+	sheets  map[string]*svgSpriteSheet
+	symbols map[string]*html.Node // by their new ID
+	ids     map[string]bool       // new IDs of all copied elements
+}
+
+// svgSpriteSheet is an external SVG that contains the sprites. It's only
+// fetched once, no matter how many elements use it.
+type svgSpriteSheet struct {
+	once sync.Once
+	doc  *html.Node
+	err  error
+}
+
+func newSVGSprites() *svgSprites {
+	return &svgSprites{
+		sheets:  make(map[string]*svgSpriteSheet),
+		symbols: make(map[string]*html.Node),
+		ids:     make(map[string]bool),
+	}
+}
+
+// sheet returns the sprite sheet for the URL.
+func (s *svgSprites) sheet(url string) *svgSpriteSheet {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sheet, exist := s.sheets[url]
+	if !exist {
+		sheet = &svgSpriteSheet{}
+		s.sheets[url] = sheet
+	}
+	return sheet
+}
+
+// addSymbol copies the element with the ID from the sprite sheet, and returns
+// its new ID in the document. Returns false if there are no such element.
+func (s *svgSprites) addSymbol(url string, id string, sheet *html.Node) (string, bool) {
+	// The ID is prefixed with hash of the sheet URL, so it's unique even
+	// when different sheets use the same ID.
+	hash := fnv.New32a()
+	hash.Write([]byte(url))
+	prefix := fmt.Sprintf("obelisk-%08x-", hash.Sum32())
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.copyElement(prefix, id, sheet)
+}
+
+// copyElement copies the element with the ID, along with the elements that
+// it refers to, e.g. gradient in its fill or symbol in its use. The IDs in
+// the copies are prefixed, so they don't collide with the document's.
+func (s *svgSprites) copyElement(prefix string, id string, sheet *html.Node) (string, bool) {
+	newID := prefix + id
+	if s.ids[newID] {
+		return newID, true
+	}
+
+	target := dom.GetElementByID(sheet, id)
+	if target == nil {
+		return "", false
+	}
+
+	symbol := cloneNode(target)
+	s.symbols[newID] = symbol
+
+	// Rename the IDs first, so references to them are not copied again. If
+	// the element already copied before, e.g. it's referred by another
+	// symbol, the existing copy is used instead.
+	nodes := append([]*html.Node{symbol}, dom.GetElementsByTagName(symbol, "*")...)
+	for _, node := range nodes {
+		nodeID := dom.GetAttribute(node, "id")
+		if nodeID == "" {
+			continue
+		}
+
+		if node != symbol && s.ids[prefix+nodeID] {
+			dom.RemoveAttribute(node, "id")
+			continue
+		}
+
+		s.ids[prefix+nodeID] = true
+		dom.SetAttribute(node, "id", prefix+nodeID)
+	}
+
+	// Then copy the referred elements and point the references to them
+	rename := func(refID string) (string, bool) {
+		return s.copyElement(prefix, refID, sheet)
+	}
+
+	for _, node := range nodes {
+		for i, attr := range node.Attr {
+			if attr.Key == "href" {
+				if refID, ok := strings.CutPrefix(attr.Val, "#"); ok {
+					if newRef, ok := rename(refID); ok {
+						node.Attr[i].Val = "#" + newRef
+					}
+				}
+				continue
+			}
+
+			node.Attr[i].Val = rxSVGURLRef.ReplaceAllStringFunc(attr.Val, func(ref string) string {
+				refID := rxSVGURLRef.FindStringSubmatch(ref)[1]
+				if newRef, ok := rename(refID); ok {
+					return "url(#" + newRef + ")"
+				}
+				return ref
+			})
+		}
+	}
+
+	return newID, true
+}
+
+// insert puts the symbols into a hidden SVG in the document.
+func (s *svgSprites) insert(doc *html.Node) {
+	if len(s.symbols) == 0 {
+		return
+	}
+
+	ids := make([]string, 0, len(s.symbols))
+	for id := range s.symbols {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	defs := &html.Node{Type: html.ElementNode, Data: "defs", Namespace: "svg"}
+	for _, id := range ids {
+		defs.AppendChild(s.symbols[id])
+	}
+
+	container := &html.Node{Type: html.ElementNode, Data: "svg", Namespace: "svg"}
+	dom.SetAttribute(container, "style", "display:none")
+	dom.SetAttribute(container, "aria-hidden", "true")
+	container.AppendChild(defs)
+
+	parent := doc
+	if bodies := dom.GetElementsByTagName(doc, "body"); len(bodies) > 0 {
+		parent = bodies[0]
+	}
+	dom.PrependChild(parent, container)
+}
+
+// processSVGUseNode inlines the symbol that used from external SVG sprite,
+// since the sprite won't be available in archive.
+func (arc *Archiver) processSVGUseNode(ctx context.Context, node *html.Node, parentURL string, sprites *svgSprites) error {
+	href := strings.TrimSpace(dom.GetAttribute(node, "href"))
+	if href == "" || strings.HasPrefix(href, "#") || isSVGSpriteContext(ctx) {
+		return nil
+	}
+
+	spriteURL, err := nurl.Parse(href)
+	if err != nil || spriteURL.Fragment == "" {
+		return nil
+	}
+
+	id := spriteURL.Fragment
+	spriteURL.Fragment = ""
+	spriteURL.RawFragment = ""
+	url := spriteURL.String()
+
+	sheet := sprites.sheet(url)
+	sheet.once.Do(func() {
+		sheet.doc, sheet.err = arc.processSVGSprite(ctx, spriteURL, parentURL)
+	})
+
+	if sheet.err != nil {
+		if sheet.err == errSkippedURL {
+			return nil
+		}
+		return sheet.err
+	}
+
+	if sheet.doc == nil {
+		return nil
+	}
+
+	if newID, ok := sprites.addSymbol(url, id, sheet.doc); ok {
+		// Both href and xlink:href are named "href" by the parser
+		for i := range node.Attr {
+			if node.Attr[i].Key == "href" {
+				node.Attr[i].Val = "#" + newID
+			}
+		}
+	}
+
+	return nil
+}
+
+// processSVGSprite fetches the external SVG sprite, then processes it like
+// HTML document so its subresources are embedded.
+func (arc *Archiver) processSVGSprite(ctx context.Context, spriteURL *nurl.URL, parentURL string) (*html.Node, error) {
+	content, contentType, err := arc.processURL(ctx, spriteURL.String(), parentURL, KindImage)
+	if err != nil {
+		return nil, err
+	}
+
+	if mediaTypeOf(contentType) != "image/svg+xml" {
+		return nil, nil
+	}
+
+	input, err := newHTMLDecoder(bytes.NewReader(content), contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	return arc.processHTMLDocument(withSVGSprite(ctx), input, spriteURL, spriteURL.String(), false)
+}
+
+// isSVGElement checks whether the node is an element of inline SVG.
+func isSVGElement(node *html.Node) bool {
+	return node.Namespace == "svg"
+}
+
+// cloneNode deeply copies the node, including its namespace which is dropped
+// by dom.Clone.
+func cloneNode(src *html.Node) *html.Node {
+	clone := &html.Node{
+		Type:      src.Type,
+		DataAtom:  src.DataAtom,
+		Data:      src.Data,
+		Namespace: src.Namespace,
+		Attr:      append([]html.Attribute{}, src.Attr...),
+	}
+
+	for child := src.FirstChild; child != nil; child = child.NextSibling {
+		clone.AppendChild(cloneNode(child))
+	}
+
+	return clone
+}
@@ -1,11 +1,15 @@
 package obelisk
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 	nurl "net/url"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -13,7 +17,7 @@ import (
 var errSkippedURL = errors.New("skip processing url")
 
 //nolint:gocyclo,unparam
-func (arc *Archiver) processURL(ctx context.Context, url string, parentURL string, embedded ...bool) ([]byte, string, error) {
+func (arc *Archiver) processURL(ctx context.Context, url string, parentURL string, kind ResourceKind, embedded ...bool) (content []byte, contentType string, err error) {
 	// Parse embedded value
 	isEmbedded := len(embedded) != 0 && embedded[0]
 
@@ -27,30 +31,207 @@ func (arc *Archiver) processURL(ctx context.Context, url string, parentURL strin
 	// some error while preparing document, so just skip this URL
 	parsedURL, err := nurl.ParseRequestURI(url)
 	if err != nil || parsedURL.Scheme == "" || parsedURL.Hostname() == "" {
+		recordResource(ctx, Resource{URL: url, ParentURL: parentURL, Kind: kind, Outcome: ResourceSkipped})
+		arc.Observer.ResourceSkipped(Event{URL: url, ParentURL: parentURL})
 		return nil, "", errSkippedURL
 	}
 
-	// Check in cache to see if this URL already processed
-	arc.RLock()
-	cache, cacheExist := arc.Cache[url]
-	arc.RUnlock()
+	// Record the resource and notify observer once it's processed
+	start := time.Now()
+	downloadStarted := false
+	res := Resource{URL: url, FinalURL: url, ParentURL: parentURL, Kind: kind}
+	arc.Observer.ResourceQueued(Event{URL: url, ParentURL: parentURL})
 
-	if cacheExist {
-		arc.logURL(url, parentURL, true)
-		return cache.Data, cache.ContentType, nil
+	defer func() {
+		res.ContentType = contentType
+		if res.Kind == KindUnknown {
+			res.Kind = resourceKindFromContentType(contentType)
+		}
+		res.Size = int64(len(content))
+		res.Duration = time.Since(start)
+
+		if res.Outcome == "" {
+			switch {
+			case err == nil:
+				res.Outcome = ResourceEmbedded
+			case err == errSkippedURL:
+				res.Outcome = ResourceSkipped
+			default:
+				res.Outcome = ResourceFailed
+				res.Error = err
+			}
+		}
+
+		recordResource(ctx, res)
+		arc.logResource(res)
+
+		e := Event{
+			URL:       url,
+			ParentURL: parentURL,
+			Bytes:     res.Size,
+			Duration:  res.Duration,
+			Err:       res.Error,
+		}
+
+		switch {
+		case res.Outcome == ResourceSkipped || res.Outcome == ResourceTooLarge:
+			arc.Observer.ResourceSkipped(e)
+		case res.Outcome == ResourceFailed:
+			arc.Observer.ResourceFailed(e)
+		case downloadStarted:
+			arc.Observer.DownloadFinished(e)
+		}
+	}()
+
+	// Check the filter rules to see if this URL should be skipped. If there
+	// are not enough information, check it again once the resource fetched.
+	skip, filterDecided := arc.filterResource(parsedURL, kind, -1, false)
+	if skip {
+		return nil, "", errSkippedURL
+	}
+
+	isFiltered := func(contentType string, size int64, final bool) bool {
+		if filterDecided {
+			return false
+		}
+
+		resKind := kind
+		if resKind == KindUnknown {
+			resKind = resourceKindFromContentType(contentType)
+		}
+
+		skip, filterDecided = arc.filterResource(parsedURL, resKind, size, final)
+		return skip
+	}
+
+	// Make sure the resource fits in the size limits. If not, it will be
+	// kept as remote URL.
+	isTooLarge := func(size int64) bool {
+		if arc.MaxResourceSize <= 0 || size <= arc.MaxResourceSize {
+			return false
+		}
+
+		res.Outcome = ResourceTooLarge
+		res.Error = ErrResourceTooLarge
+		return true
+	}
+
+	// exceedsBudget checks the size against the remaining budget without
+	// taking it, so the resource can be rejected before it's downloaded.
+	exceedsBudget := func(size int64) bool {
+		remaining := sizeBudgetFromContext(ctx).available()
+		if remaining < 0 || size <= remaining {
+			return false
+		}
+
+		res.Outcome = ResourceTooLarge
+		res.Error = ErrArchiveTooLarge
+		return true
+	}
+
+	isOverBudget := func(size int64) bool {
+		budget := sizeBudgetFromContext(ctx)
+		if budget == nil || budget.reserve(size) {
+			return false
+		}
+
+		res.Outcome = ResourceTooLarge
+		res.Error = ErrArchiveTooLarge
+		return true
+	}
+
+	// Check in cache to see if this URL already downloaded. If not, make sure
+	// it's only fetched once at a time. The other fetches wait for it, then
+	// use the fetched asset like the cached one. The cache only keeps the
+	// raw content, so HTML and CSS are always processed with the options of
+	// the current request.
+	cache, cacheExist := arc.Cache.Get(url)
+	cacheFresh := cacheExist && cache.isFresh(time.Now())
+
+	// Imported stylesheet is not coalesced, since it might be imported by
+	// another stylesheet that it imports, which makes both of them waiting
+	// for each other.
+	isImport := kind == KindStylesheet && len(cssImportsFromContext(ctx)) > 0
+
+	var flight *fetchFlight
+	if !cacheFresh && !isImport {
+		var leader bool
+		flights := fetchFlightsFromContext(ctx)
+		flight, leader = flights.join(url)
+
+		if leader {
+			defer func() { flights.finish(url, flight, res, err) }()
+		} else {
+			if err = flight.wait(ctx); err != nil {
+				return nil, "", err
+			}
+
+			if flight.asset == nil {
+				res.FinalURL = flight.res.FinalURL
+				res.StatusCode = flight.res.StatusCode
+				res.Outcome = flight.res.Outcome
+				res.Error = flight.res.Error
+				return nil, "", flight.err
+			}
+
+			cache, cacheExist, cacheFresh = *flight.asset, true, true
+		}
+	}
+
+	if cacheFresh {
+		if isFiltered(cache.ContentType, int64(len(cache.Data)), true) {
+			return nil, "", errSkippedURL
+		}
+
+		if isTooLarge(int64(len(cache.Data))) || isOverBudget(int64(len(cache.Data))) {
+			return nil, "", errSkippedURL
+		}
+
+		arc.Observer.CacheHit(Event{URL: url, ParentURL: parentURL, Bytes: int64(len(cache.Data))})
+		res.Cached = true
+		return arc.processContent(ctx, cache, parsedURL, isEmbedded)
+	}
+
+	// If the cached asset is stale, ask server whether it's still valid
+	var reqHeader http.Header
+	if cacheExist && cache.canRevalidate() {
+		reqHeader = cache.conditionalHeader()
+	}
+
+	// Download the resource, use semaphore to limit concurrent downloads.
+	// The host slot is taken first, so download slot is not held while
+	// waiting for a busy host.
+	arc.logger.Debug("downloading resource", "url", url, "parent", parentURL)
+	releaseHost, err := arc.hostLimiter.acquire(ctx, parsedURL.Host)
+	if err != nil {
+		res.Outcome = ResourceFailed
+		res.Error = err
+		return nil, "", err
 	}
 
-	// Download the resource, use semaphore to limit concurrent downloads
-	arc.logURL(url, parentURL, false)
 	err = arc.dlSemaphore.Acquire(ctx, 1)
 	if err != nil {
-		return nil, "", nil
+		releaseHost()
+		res.Outcome = ResourceFailed
+		res.Error = err
+		return nil, "", err
 	}
 
-	resp, err := arc.downloadFile(url, parentURL)
+	downloadStarted = true
+	arc.Observer.DownloadStarted(Event{URL: url, ParentURL: parentURL})
+	resp, err := arc.downloadFile(ctx, url, parentURL, reqHeader)
 	arc.dlSemaphore.Release(1)
+	releaseHost()
 	if err != nil {
-		if arc.SkipResourceURLError {
+		res.Outcome = ResourceFailed
+		res.Error = err
+		if resp != nil {
+			res.StatusCode = resp.StatusCode
+		}
+
+		// Cancelled archival must not be skipped, so it's not finished
+		// with resources missing
+		if arc.SkipResourceURLError && ctx.Err() == nil {
 			return nil, "", errSkippedURL
 		} else {
 			return nil, "", fmt.Errorf("download failed: %w", err)
@@ -58,48 +239,136 @@ func (arc *Archiver) processURL(ctx context.Context, url string, parentURL strin
 	}
 	defer resp.Body.Close()
 
-	// Get content type
-	contentType := resp.Header.Get("Content-Type")
-	contentType = strings.TrimSpace(contentType)
-	if contentType == "" {
-		contentType = "text/plain"
-	}
+	res.FinalURL = resp.Request.URL.String()
+	res.StatusCode = resp.StatusCode
 
-	// Read content of response body. If the downloaded file is HTML
-	// or CSS it need to be processed again
-	var bodyContent []byte
+	// If the asset not modified, reuse the cached one
+	if resp.StatusCode == http.StatusNotModified && cacheExist {
+		flight.share(cache)
+		if isFiltered(cache.ContentType, int64(len(cache.Data)), true) {
+			return nil, "", errSkippedURL
+		}
 
-	switch {
-	case contentType == "text/html" && isEmbedded:
-		newHTML, err := arc.processHTML(ctx, resp.Body, parsedURL, false)
-		if err == nil {
-			bodyContent = s2b(newHTML)
-		} else {
-			return nil, "", err
+		if isTooLarge(int64(len(cache.Data))) || isOverBudget(int64(len(cache.Data))) {
+			return nil, "", errSkippedURL
 		}
 
-	case contentType == "text/css":
-		newCSS, err := arc.processCSS(ctx, resp.Body, parsedURL)
-		if err == nil {
-			bodyContent = s2b(newCSS)
+		arc.Observer.CacheHit(Event{URL: url, ParentURL: parentURL, Bytes: int64(len(cache.Data))})
+		res.Cached = true
+		if cache.updateFromHeader(resp.Header, time.Now()) {
+			arc.Cache.Put(url, cache)
 		} else {
-			return nil, "", err
+			arc.Cache.Delete(url)
 		}
+		return arc.processContent(ctx, cache, parsedURL, isEmbedded)
+	}
 
-	default:
-		bodyContent, err = io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, "", err
+	// Get content type. If server doesn't specify it properly, guess it
+	// from the referencing element, file extension or content. Error page
+	// is not what the element expects, so only its content is checked.
+	hintKind, hintURL := kind, resp.Request.URL
+	if resp.StatusCode >= http.StatusBadRequest {
+		hintKind, hintURL = KindUnknown, nil
+	}
+
+	respBody := bufio.NewReader(resp.Body)
+	contentType = resolveContentType(resp.Header.Get("Content-Type"), hintKind, hintURL, respBody)
+
+	// Check the filter again, now the content type and maybe size are known
+	if isFiltered(contentType, resp.ContentLength, false) {
+		return nil, "", errSkippedURL
+	}
+
+	if isTooLarge(resp.ContentLength) || exceedsBudget(resp.ContentLength) {
+		return nil, "", errSkippedURL
+	}
+
+	// Read content of response body. It's stopped once the content doesn't
+	// fit in either the resource limit or the remaining budget.
+	limit := sizeBudgetFromContext(ctx).available()
+	if arc.MaxResourceSize > 0 && (limit < 0 || arc.MaxResourceSize < limit) {
+		limit = arc.MaxResourceSize
+	}
+
+	body := &sizeLimitReader{r: respBody, limit: limit}
+	bodyContent, err := io.ReadAll(body)
+	if body.exceeded {
+		if !isTooLarge(body.n) {
+			exceedsBudget(body.n)
 		}
+		return nil, "", errSkippedURL
+	}
+
+	if err != nil {
+		return nil, "", err
 	}
 
-	// Save data URL to cache
-	arc.Lock()
-	arc.Cache[url] = Asset{
+	// Save the raw content to cache, as long as server allows it
+	asset := Asset{
 		Data:        bodyContent,
 		ContentType: contentType,
 	}
-	arc.Unlock()
+	if asset.updateFromHeader(resp.Header, time.Now()) {
+		arc.Cache.Put(url, asset)
+	} else if cacheExist {
+		arc.Cache.Delete(url)
+	}
+
+	flight.share(asset)
+
+	if isFiltered(contentType, int64(len(bodyContent)), true) {
+		return nil, "", errSkippedURL
+	}
+
+	// For processed document, its embedded assets are taken from the
+	// budget by themselves, so only take the size of the document itself.
+	if isOverBudget(int64(len(bodyContent))) {
+		return nil, "", errSkippedURL
+	}
+
+	return arc.processContent(ctx, asset, parsedURL, isEmbedded)
+}
+
+// processContent processes the downloaded HTML or CSS, so the resources that
+// used by them are embedded as well. The other assets are returned as it is.
+func (arc *Archiver) processContent(ctx context.Context, asset Asset, assetURL *nurl.URL, isEmbedded bool) ([]byte, string, error) {
+	// The processed content is embedded whole into its parent, so its own
+	// assets must not be deferred for streaming.
+	ctx = withDeferredAssets(ctx, nil)
+
+	var err error
+	var content []byte
+	var contentType string
+	var input io.Reader
+
+	switch mediaType := mediaTypeOf(asset.ContentType); {
+	case (mediaType == "text/html" || mediaType == "application/xhtml+xml") && isEmbedded:
+		var newHTML string
+		if input, err = newHTMLDecoder(bytes.NewReader(asset.Data), asset.ContentType); err == nil {
+			newHTML, err = arc.processHTML(ctx, input, assetURL, assetURL.String(), false)
+			content, contentType = s2b(newHTML), "text/html; charset=utf-8"
+		}
+
+	case mediaType == "text/css":
+		var newCSS string
+		if input, err = newCSSDecoder(bytes.NewReader(asset.Data), asset.ContentType); err == nil {
+			newCSS, err = arc.processCSS(ctx, input, assetURL, assetURL.String())
+			content, contentType = s2b(newCSS), "text/css; charset=utf-8"
+		}
+
+	default:
+		return asset.Data, asset.ContentType, nil
+	}
+
+	// Processed content might have its assets left out when the archival
+	// is cancelled, so it's not used
+	if err == nil {
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
 
-	return bodyContent, contentType, nil
+	return content, contentType, nil
 }
@@ -0,0 +1,187 @@
+package obelisk
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/go-shiori/dom"
+	"golang.org/x/net/html"
+)
+
+// resourceAttr is an attribute of element that refers to a resource.
+type resourceAttr struct {
+	tag  string
+	attr string
+	kind ResourceKind
+
+	// match checks whether the element fits this entry, nil matches all
+	// elements with the tag.
+	match func(node *html.Node) bool
+
+	isSrcset     bool // the attribute contains a srcset instead of single URL
+	isMedia      bool // the resource is removed when medias are disabled
+	isEmbed      bool // the resource is removed when embeds are disabled
+	linkOnly     bool // the URL is only made absolute, never embedded
+	keepFragment bool // the fragment is kept, e.g. for symbol in SVG sprite
+}
+
+// resourceAttrs lists the attributes that refer to resources. The URLs in them
+// are made absolute, then embedded into the archive. If several entries fit
+// the same attribute of an element, the first one is used.
+var resourceAttrs = []resourceAttr{
+	{tag: "a", attr: "href", linkOnly: true},
+	{tag: "area", attr: "href", linkOnly: true},
+
+	{tag: "link", attr: "href", kind: KindStylesheet, match: hasLinkRel("stylesheet")},
+	{tag: "link", attr: "href", kind: KindImage, isMedia: true, match: isLinkIcon},
+	{tag: "link", attr: "href", kind: KindFont, match: isLinkPreload("font")},
+	{tag: "link", attr: "href", kind: KindImage, isMedia: true, match: isLinkPreload("image")},
+	{tag: "link", attr: "href", kind: KindStylesheet, match: isLinkPreload("style")},
+	{tag: "link", attr: "href", linkOnly: true},
+
+	{tag: "meta", attr: "content", kind: KindImage, isMedia: true, match: isMetaImage},
+
+	{tag: "script", attr: "src", kind: KindScript},
+	{tag: "iframe", attr: "src", kind: KindFrame, isEmbed: true},
+	{tag: "embed", attr: "src", kind: KindFrame, isEmbed: true},
+	{tag: "object", attr: "data", kind: KindFrame, isEmbed: true},
+	{tag: "param", attr: "value", kind: KindFrame, isEmbed: true, match: isObjectParamURL},
+
+	{tag: "img", attr: "src", kind: KindImage, isMedia: true},
+	{tag: "img", attr: "srcset", kind: KindImage, isSrcset: true, isMedia: true},
+	{tag: "picture", attr: "src", kind: KindImage, isMedia: true},
+	{tag: "picture", attr: "srcset", kind: KindImage, isSrcset: true, isMedia: true},
+	{tag: "figure", attr: "src", kind: KindImage, isMedia: true},
+	{tag: "figure", attr: "srcset", kind: KindImage, isSrcset: true, isMedia: true},
+	{tag: "input", attr: "src", kind: KindImage, isMedia: true, match: isImageInput},
+
+	{tag: "video", attr: "src", kind: KindVideo, isMedia: true},
+	{tag: "video", attr: "poster", kind: KindImage, isMedia: true},
+	{tag: "audio", attr: "src", kind: KindAudio, isMedia: true},
+	{tag: "track", attr: "src", isMedia: true},
+
+	{tag: "source", attr: "src", kind: KindVideo, isMedia: true, match: hasParent("video")},
+	{tag: "source", attr: "src", kind: KindAudio, isMedia: true, match: hasParent("audio")},
+	{tag: "source", attr: "srcset", kind: KindImage, isSrcset: true, isMedia: true, match: hasParent("picture")},
+	{tag: "source", attr: "src", isMedia: true},
+	{tag: "source", attr: "srcset", isSrcset: true, isMedia: true},
+
+	{tag: "image", attr: "href", kind: KindImage, isMedia: true, match: isSVGElement},
+	{tag: "feImage", attr: "href", kind: KindImage, isMedia: true, match: isSVGElement},
+	{tag: "use", attr: "href", linkOnly: true, keepFragment: true, match: isSVGElement},
+
+	{tag: "body", attr: "background", kind: KindImage, isMedia: true},
+	{tag: "table", attr: "background", kind: KindImage, isMedia: true},
+	{tag: "tr", attr: "background", kind: KindImage, isMedia: true},
+	{tag: "td", attr: "background", kind: KindImage, isMedia: true},
+	{tag: "th", attr: "background", kind: KindImage, isMedia: true},
+}
+
+// resourceAttrsOf returns the entries for resource attributes that exist in
+// the node, one entry for each attribute.
+func resourceAttrsOf(node *html.Node) []resourceAttr {
+	var entries []resourceAttr
+	tagName := dom.TagName(node)
+	for _, entry := range resourceAttrs {
+		if entry.tag != tagName || !dom.HasAttribute(node, entry.attr) {
+			continue
+		}
+
+		if entry.match != nil && !entry.match(node) {
+			continue
+		}
+
+		isDuplicate := slices.ContainsFunc(entries, func(existing resourceAttr) bool {
+			return existing.attr == entry.attr
+		})
+
+		if !isDuplicate {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// resourceKindFromNode guesses the kind of resource in attribute of the node.
+func resourceKindFromNode(node *html.Node, attrName string) ResourceKind {
+	for _, entry := range resourceAttrsOf(node) {
+		if entry.attr == attrName {
+			return entry.kind
+		}
+	}
+	return KindUnknown
+}
+
+// hasLinkRel matches link that has any of the relationships.
+func hasLinkRel(rels ...string) func(*html.Node) bool {
+	return func(node *html.Node) bool {
+		for _, rel := range strings.Fields(strings.ToLower(dom.GetAttribute(node, "rel"))) {
+			for _, expected := range rels {
+				if rel == expected {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// isLinkIcon matches link for icons, including apple-touch-icon and
+// mask-icon.
+func isLinkIcon(node *html.Node) bool {
+	for _, rel := range strings.Fields(strings.ToLower(dom.GetAttribute(node, "rel"))) {
+		if strings.Contains(rel, "icon") {
+			return true
+		}
+	}
+	return false
+}
+
+// isLinkPreload matches link that preloads resource with the type.
+func isLinkPreload(as string) func(*html.Node) bool {
+	isPreload := hasLinkRel("preload")
+	return func(node *html.Node) bool {
+		return isPreload(node) && strings.EqualFold(dom.GetAttribute(node, "as"), as)
+	}
+}
+
+// hasParent matches element whose parent has the tag name.
+func hasParent(tagName string) func(*html.Node) bool {
+	return func(node *html.Node) bool {
+		return node.Parent != nil && dom.TagName(node.Parent) == tagName
+	}
+}
+
+// isMetaImage matches meta for image that shown when the page is shared.
+func isMetaImage(node *html.Node) bool {
+	switch strings.ToLower(dom.GetAttribute(node, "property")) {
+	case "og:image", "og:image:url", "og:image:secure_url":
+		return true
+	}
+
+	switch strings.ToLower(dom.GetAttribute(node, "name")) {
+	case "twitter:image", "twitter:image:src":
+		return true
+	}
+
+	return false
+}
+
+// isImageInput matches input which is an image button.
+func isImageInput(node *html.Node) bool {
+	return strings.EqualFold(dom.GetAttribute(node, "type"), "image")
+}
+
+// isObjectParamURL matches param of object that contains URL of the resource.
+func isObjectParamURL(node *html.Node) bool {
+	if node.Parent == nil || dom.TagName(node.Parent) != "object" {
+		return false
+	}
+
+	switch strings.ToLower(dom.GetAttribute(node, "name")) {
+	case "movie", "src", "url", "filename", "data":
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,111 @@
+package obelisk
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// ResourceOutcome is the final state of a resource in the archive.
+type ResourceOutcome string
+
+const (
+	// ResourceEmbedded means the resource is downloaded and embedded in the archive.
+	ResourceEmbedded ResourceOutcome = "embedded"
+	// ResourceSkipped means the resource is not processed, so it's kept as remote URL.
+	ResourceSkipped ResourceOutcome = "skipped"
+	// ResourceFailed means the resource is failed to download or process.
+	ResourceFailed ResourceOutcome = "failed"
+	// ResourceTooLarge means the resource exceeds the size limits, so it's kept as remote URL.
+	ResourceTooLarge ResourceOutcome = "too-large"
+)
+
+// Resource is the record of a subresource found while archiving a web page.
+type Resource struct {
+	URL         string
+	FinalURL    string // URL after redirects
+	ParentURL   string
+	StatusCode  int
+	ContentType string
+	Kind        ResourceKind
+	Size        int64
+	Duration    time.Duration
+	Cached      bool
+	Outcome     ResourceOutcome
+	Error       error
+}
+
+// ArchiveResult is the result of an archival process.
+type ArchiveResult struct {
+	URL         string // URL as requested
+	FinalURL    string // URL after redirects
+	StatusCode  int
+	ContentType string
+	Size        int64 // size of the archive that written to output
+	Resources   []Resource
+}
+
+type ctxKeyResourceRecorder struct{}
+
+func withResourceRecorder(ctx context.Context, recorder *resourceRecorder) context.Context {
+	return context.WithValue(ctx, ctxKeyResourceRecorder{}, recorder)
+}
+
+func resourceRecorderFromContext(ctx context.Context) *resourceRecorder {
+	if recorder, ok := ctx.Value(ctxKeyResourceRecorder{}).(*resourceRecorder); ok {
+		return recorder
+	}
+	return nil
+}
+
+// resourceRecorder collects the resources of a web page. Each URL only
+// recorded once, unless the new record is better than the old one.
+type resourceRecorder struct {
+	sync.Mutex
+	resources []Resource
+	indexes   map[string]int
+}
+
+func newResourceRecorder() *resourceRecorder {
+	return &resourceRecorder{indexes: make(map[string]int)}
+}
+
+func (r *resourceRecorder) record(res Resource) {
+	r.Lock()
+	defer r.Unlock()
+
+	idx, exist := r.indexes[res.URL]
+	switch {
+	case !exist:
+		r.indexes[res.URL] = len(r.resources)
+		r.resources = append(r.resources, res)
+	case r.resources[idx].Outcome != ResourceEmbedded && res.Outcome == ResourceEmbedded:
+		r.resources[idx] = res
+	}
+}
+
+func (r *resourceRecorder) list() []Resource {
+	r.Lock()
+	defer r.Unlock()
+	return append([]Resource(nil), r.resources...)
+}
+
+// recordResource saves the resource into the recorder in context, if any.
+func recordResource(ctx context.Context, res Resource) {
+	if recorder := resourceRecorderFromContext(ctx); recorder != nil {
+		recorder.record(res)
+	}
+}
+
+// countingWriter is io.Writer that counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,188 @@
+package obelisk
+
+import (
+	"context"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetryPolicy decides whether a failed request should be retried.
+type RetryPolicy interface {
+	// Retry is called after each attempt with its response or error.
+	// Attempt starts from 1 for the first request. Returns how long to
+	// wait before the next attempt, or false if it should not be retried.
+	Retry(attempt int, resp *http.Response, err error) (delay time.Duration, retry bool)
+}
+
+// FailureStatusPolicy is implemented by RetryPolicy that decides which status
+// codes are failures. Once response with such status is no longer retried, it's
+// returned as error instead of embedded. For RetryPolicy that doesn't implement
+// it, 5xx and 429 are the failures.
+type FailureStatusPolicy interface {
+	IsFailureStatus(statusCode int) bool
+}
+
+// DefaultRetryStatusCodes are the status codes that retried by default.
+var DefaultRetryStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// BackoffRetry is RetryPolicy that waits with exponential backoff between
+// attempts, unless server tells how long to wait using Retry-After header.
+type BackoffRetry struct {
+	// MaxRetries is the maximum number of retries after the first attempt.
+	MaxRetries int
+
+	// StatusCodes are the status codes that should be retried. Once they
+	// are no longer retried, the response is failed.
+	StatusCodes []int
+
+	// RetryNetworkErrors retries the request that failed without response,
+	// e.g. because of connection reset or timeout.
+	RetryNetworkErrors bool
+
+	// BaseDelay is the delay before the first retry, which doubled on each
+	// next retry up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Jitter randomizes the delay to avoid retrying at the same time as
+	// other requests. It's a fraction between 0 and 1 of the delay that
+	// might be cut off.
+	Jitter float64
+
+	// IgnoreRetryAfter ignores Retry-After header in response. If it's not
+	// ignored and server asks to wait longer than MaxDelay, the request
+	// will not be retried.
+	IgnoreRetryAfter bool
+}
+
+// NewBackoffRetry returns BackoffRetry with the default configuration.
+func NewBackoffRetry(maxRetries int) *BackoffRetry {
+	return &BackoffRetry{
+		MaxRetries:         maxRetries,
+		StatusCodes:        DefaultRetryStatusCodes,
+		RetryNetworkErrors: true,
+		BaseDelay:          500 * time.Millisecond,
+		MaxDelay:           30 * time.Second,
+		Jitter:             0.5,
+	}
+}
+
+// Retry implements RetryPolicy.
+func (br *BackoffRetry) Retry(attempt int, resp *http.Response, err error) (time.Duration, bool) {
+	if attempt > br.MaxRetries {
+		return 0, false
+	}
+
+	switch {
+	case resp != nil:
+		if !containsStatusCode(br.StatusCodes, resp.StatusCode) {
+			return 0, false
+		}
+
+		if !br.IgnoreRetryAfter {
+			if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				return delay, br.MaxDelay <= 0 || delay <= br.MaxDelay
+			}
+		}
+
+	case err != nil:
+		if !br.RetryNetworkErrors {
+			return 0, false
+		}
+
+	default:
+		return 0, false
+	}
+
+	// Compute the exponential delay, then cut it by random jitter
+	delay := float64(br.BaseDelay) * math.Pow(2, float64(attempt-1))
+	if br.MaxDelay > 0 {
+		delay = math.Min(delay, float64(br.MaxDelay))
+	}
+
+	if br.Jitter > 0 {
+		delay -= delay * math.Min(br.Jitter, 1) * rand.Float64() //nolint:gosec
+	}
+
+	return time.Duration(delay), true
+}
+
+// IsFailureStatus implements FailureStatusPolicy. The status codes that
+// retried are the failures.
+func (br *BackoffRetry) IsFailureStatus(statusCode int) bool {
+	return containsStatusCode(br.StatusCodes, statusCode)
+}
+
+// isFailureStatus checks whether response with the status code is failed,
+// following the retry policy.
+func isFailureStatus(policy RetryPolicy, statusCode int) bool {
+	if policy, ok := policy.(FailureStatusPolicy); ok {
+		return policy.IsFailureStatus(statusCode)
+	}
+	return statusCode >= http.StatusInternalServerError || statusCode == http.StatusTooManyRequests
+}
+
+// parseRetryAfter parses the value of Retry-After header, which is either
+// delay in seconds or HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := date.Sub(now); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+func containsStatusCode(codes []int, code int) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// discardBody drains and closes the response body, so its connection can
+// be reused for the next request.
+func discardBody(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+}
+
+// sleepContext waits for the duration, or until the context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
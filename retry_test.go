@@ -0,0 +1,106 @@
+package obelisk
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		value         string
+		expectedDelay time.Duration
+		expectedOK    bool
+	}{
+		{"seconds", "120", 2 * time.Minute, true},
+		{"zero seconds", "0", 0, true},
+		{"seconds with spaces", " 5 ", 5 * time.Second, true},
+		{"negative seconds", "-5", 0, false},
+		{"http date", "Mon, 01 Jan 2024 12:00:30 GMT", 30 * time.Second, true},
+		{"obsolete date format", "Monday, 01-Jan-24 12:01:00 GMT", time.Minute, true},
+		{"date in the past", "Mon, 01 Jan 2024 11:00:00 GMT", 0, true},
+		{"empty", "", 0, false},
+		{"fraction", "1.5", 0, false},
+		{"garbage", "soon", 0, false},
+		{"invalid date", "Mon, 32 Jan 2024 12:00:00 GMT", 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delay, ok := parseRetryAfter(test.value, now)
+			if delay != test.expectedDelay || ok != test.expectedOK {
+				t.Errorf("parseRetryAfter(%q) = (%v, %v), want (%v, %v)",
+					test.value, delay, ok, test.expectedDelay, test.expectedOK)
+			}
+		})
+	}
+}
+
+func TestDownloadFileFailureStatus(t *testing.T) {
+	var requests atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/timeout":
+			w.WriteHeader(http.StatusRequestTimeout)
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	policy := NewBackoffRetry(1)
+	policy.StatusCodes = []int{http.StatusRequestTimeout}
+	policy.BaseDelay = time.Millisecond
+
+	tests := []struct {
+		path             string
+		policy           RetryPolicy
+		expectedFailed   bool
+		expectedRequests int64
+	}{
+		{"/timeout", policy, true, 2},
+		{"/unavailable", policy, false, 1},
+		{"/missing", policy, false, 1},
+		{"/unavailable", retryPolicyFunc(noRetry), true, 1},
+		{"/timeout", retryPolicyFunc(noRetry), false, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			requests.Store(0)
+			arc := New(WithRetryPolicy(test.policy))
+			resp, err := arc.downloadFile(context.Background(), srv.URL+test.path, "", nil)
+			if resp != nil {
+				resp.Body.Close()
+			}
+
+			if failed := err != nil; failed != test.expectedFailed {
+				t.Errorf("got error %v, want failed %v", err, test.expectedFailed)
+			}
+
+			if n := requests.Load(); n != test.expectedRequests {
+				t.Errorf("got %d requests, want %d", n, test.expectedRequests)
+			}
+		})
+	}
+}
+
+// retryPolicyFunc is RetryPolicy that doesn't decide the failure status.
+type retryPolicyFunc func(attempt int, resp *http.Response, err error) (time.Duration, bool)
+
+func (f retryPolicyFunc) Retry(attempt int, resp *http.Response, err error) (time.Duration, bool) {
+	return f(attempt, resp, err)
+}
+
+func noRetry(int, *http.Response, error) (time.Duration, bool) {
+	return 0, false
+}
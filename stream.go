@@ -0,0 +1,182 @@
+package obelisk
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// streamThreshold is the minimum size of asset whose data URL will be
+// encoded straight into the output writer instead of kept inside document.
+var streamThreshold = 32 * 1024
+
+// assetIndexLen is length of the hex encoded index in placeholder.
+const assetIndexLen = 8
+
+type ctxKeyDeferredAssets struct{}
+
+func withDeferredAssets(ctx context.Context, assets *deferredAssets) context.Context {
+	return context.WithValue(ctx, ctxKeyDeferredAssets{}, assets)
+}
+
+func deferredAssetsFromContext(ctx context.Context) *deferredAssets {
+	if assets, ok := ctx.Value(ctxKeyDeferredAssets{}).(*deferredAssets); ok {
+		return assets
+	}
+	return nil
+}
+
+// deferredAssets keeps large assets whose data URL will be written later,
+// when the document serialized. In document, each of them is represented
+// by a placeholder that made of an unique marker and the asset index.
+type deferredAssets struct {
+	sync.Mutex
+	marker []byte
+	assets []Asset
+}
+
+func newDeferredAssets() *deferredAssets {
+	nonce := make([]byte, 8)
+	_, _ = rand.Read(nonce)
+
+	return &deferredAssets{
+		marker: []byte("obelisk-" + hex.EncodeToString(nonce) + "-"),
+	}
+}
+
+// add saves the asset and returns the placeholder for it. If the content
+// type can't be safely written into HTML as it is, it returns false.
+func (d *deferredAssets) add(content []byte, contentType string) (string, bool) {
+	if strings.ContainsAny(contentType, "&'<>\"\r\n") {
+		return "", false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	idx := len(d.assets)
+	d.assets = append(d.assets, Asset{Data: content, ContentType: contentType})
+	return fmt.Sprintf("%s%0*x", d.marker, assetIndexLen, idx), true
+}
+
+// writer returns io.Writer which replaces every placeholder with
+// the data URL of its asset before writing it to w.
+func (d *deferredAssets) writer(w io.Writer) *dataURLWriter {
+	return &dataURLWriter{w: w, deferred: d}
+}
+
+type dataURLWriter struct {
+	w        io.Writer
+	deferred *deferredAssets
+	pending  []byte
+}
+
+func (dw *dataURLWriter) Write(p []byte) (int, error) {
+	dw.pending = append(dw.pending, p...)
+	if err := dw.drain(false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes all of pending data into the underlying writer.
+func (dw *dataURLWriter) Flush() error {
+	return dw.drain(true)
+}
+
+func (dw *dataURLWriter) drain(final bool) error {
+	marker := dw.deferred.marker
+
+	for {
+		idx := bytes.Index(dw.pending, marker)
+		if idx < 0 {
+			break
+		}
+
+		// Write everything before the placeholder
+		if _, err := dw.w.Write(dw.pending[:idx]); err != nil {
+			return err
+		}
+		dw.pending = dw.pending[idx:]
+
+		// Wait until the entire placeholder received
+		end := len(marker) + assetIndexLen
+		if end > len(dw.pending) {
+			if !final {
+				dw.compact()
+				return nil
+			}
+			break
+		}
+
+		if err := dw.writeDataURL(dw.pending[len(marker):end]); err != nil {
+			return err
+		}
+		dw.pending = dw.pending[end:]
+	}
+
+	// Hold the tail which might be the start of a placeholder
+	keep := 0
+	if !final {
+		keep = partialPrefixLen(dw.pending, marker)
+	}
+
+	if _, err := dw.w.Write(dw.pending[:len(dw.pending)-keep]); err != nil {
+		return err
+	}
+	dw.pending = dw.pending[len(dw.pending)-keep:]
+	dw.compact()
+	return nil
+}
+
+// writeDataURL encodes the asset for the hex index straight to the writer.
+func (dw *dataURLWriter) writeDataURL(hexIdx []byte) error {
+	idx, err := strconv.ParseUint(string(hexIdx), 16, 32)
+	if err != nil || idx >= uint64(len(dw.deferred.assets)) {
+		// Not our placeholder, so write it as it is
+		_, err := dw.w.Write(dw.deferred.marker)
+		if err == nil {
+			_, err = dw.w.Write(hexIdx)
+		}
+		return err
+	}
+
+	asset := dw.deferred.assets[idx]
+	if _, err := io.WriteString(dw.w, "data:"+dataURLMediaType(asset.ContentType)+";base64,"); err != nil {
+		return err
+	}
+
+	encoder := base64.NewEncoder(base64.StdEncoding, dw.w)
+	if _, err := encoder.Write(asset.Data); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// compact moves the pending data to the start of its buffer.
+func (dw *dataURLWriter) compact() {
+	dw.pending = append(dw.pending[:0:0], dw.pending...)
+}
+
+// partialPrefixLen returns length of the longest suffix of b
+// that is a prefix of marker.
+func partialPrefixLen(b, marker []byte) int {
+	maxLen := len(marker) - 1
+	if len(b) < maxLen {
+		maxLen = len(b)
+	}
+
+	for n := maxLen; n > 0; n-- {
+		if bytes.HasPrefix(marker, b[len(b)-n:]) {
+			return n
+		}
+	}
+	return 0
+}
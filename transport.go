@@ -0,0 +1,169 @@
+package obelisk
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	nurl "net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ProxyRule decides the proxy for requests to the hosts. Rules are checked
+// in order and the first matching rule is used. If there are no matching
+// rules, proxy from environment variables is used.
+type ProxyRule struct {
+	// Hosts matches requests to the hosts, including their subdomains.
+	// Empty hosts matches every request.
+	Hosts []string
+
+	// URL is the proxy URL, or nil to send the request directly.
+	URL *nurl.URL
+}
+
+// ParseProxyURL parses proxy URL with scheme http, https, socks5 or socks5h.
+// Both socks5 and socks5h resolve host names through the proxy, so they can
+// be used for .onion hosts. URL without scheme is treated as HTTP proxy,
+// while "direct" returns nil URL for connecting without proxy.
+func ParseProxyURL(rawURL string) (*nurl.URL, error) {
+	rawURL = strings.TrimSpace(rawURL)
+	if rawURL == "direct" {
+		return nil, nil
+	}
+
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+
+	proxyURL, err := nurl.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5":
+	case "socks5h":
+		// Older Go only knows socks5, which already resolves host remotely
+		proxyURL.Scheme = "socks5"
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", proxyURL.Scheme)
+	}
+
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("proxy host is not specified: %s", rawURL)
+	}
+
+	return proxyURL, nil
+}
+
+// resolveTransport returns the transport that will be used by archiver. If
+// custom transport is not specified, it's built from archiver's network
+// configuration.
+func (arc *Archiver) resolveTransport() http.RoundTripper {
+	if arc.Transport != nil {
+		return arc.Transport
+	}
+
+	if len(arc.Proxies) == 0 && !arc.InsecureSkipVerify && arc.RootCAs == nil &&
+		len(arc.ClientCertificates) == 0 && len(arc.ResolveOverrides) == 0 {
+		return http.DefaultTransport
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(arc.Proxies) > 0 {
+		transport.Proxy = proxyFunc(arc.Proxies)
+	}
+
+	if arc.InsecureSkipVerify || arc.RootCAs != nil || len(arc.ClientCertificates) > 0 {
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: arc.InsecureSkipVerify, //nolint:gosec
+			RootCAs:            arc.RootCAs,
+			Certificates:       arc.ClientCertificates,
+		}
+	}
+
+	if len(arc.ResolveOverrides) > 0 {
+		transport.DialContext = resolveDialer(arc.ResolveOverrides)
+	}
+
+	return transport
+}
+
+// resolveDialer returns dial function that connects to the overridden
+// address instead of resolving the host.
+func resolveDialer(overrides map[string]string) func(context.Context, string, string) (net.Conn, error) {
+	addresses := make(map[string]string, len(overrides))
+	for hostPort, address := range overrides {
+		addresses[strings.ToLower(hostPort)] = strings.Trim(address, "[]")
+	}
+
+	// Same as the dialer in http.DefaultTransport
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if address, exist := addresses[strings.ToLower(addr)]; exist {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			addr = net.JoinHostPort(address, port)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// hostHeaderTransport adds the host headers into each request, including the
+// redirected ones. Since the headers are not added into the original request,
+// they are never copied to redirect into other hosts.
+type hostHeaderTransport struct {
+	base        http.RoundTripper
+	hostHeaders map[string]http.Header
+}
+
+func (t *hostHeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// If several hosts match, the more specific one is applied last
+	var hosts []string
+	for pattern := range t.hostHeaders {
+		if matchHosts(req.URL.Hostname(), []string{pattern}) {
+			hosts = append(hosts, pattern)
+		}
+	}
+
+	if len(hosts) == 0 {
+		return t.base.RoundTrip(req)
+	}
+
+	sort.Slice(hosts, func(i, j int) bool { return len(hosts[i]) < len(hosts[j]) })
+	req = req.Clone(req.Context())
+	for _, host := range hosts {
+		header := t.hostHeaders[host]
+		for key := range header {
+			req.Header.Del(key)
+		}
+
+		for key, values := range header {
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
+		}
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+func proxyFunc(rules []ProxyRule) func(*http.Request) (*nurl.URL, error) {
+	return func(req *http.Request) (*nurl.URL, error) {
+		for _, rule := range rules {
+			if len(rule.Hosts) == 0 || matchHosts(req.URL.Hostname(), rule.Hosts) {
+				return rule.URL, nil
+			}
+		}
+		return http.ProxyFromEnvironment(req)
+	}
+}
@@ -87,7 +87,7 @@ func sanitizeStyleURL(url string) string {
 // createDataURL returns base64 encoded data URL
 func createDataURL(content []byte, contentType string) string {
 	b64encoded := base64.StdEncoding.EncodeToString(content)
-	return fmt.Sprintf("data:%s;base64,%s", contentType, b64encoded)
+	return fmt.Sprintf("data:%s;base64,%s", dataURLMediaType(contentType), b64encoded)
 }
 
 // s2b converts string to a byte slice without memory allocation.